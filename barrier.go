@@ -0,0 +1,154 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"github.com/fsnotify/fsnotify"
+)
+
+// barrierFilePrefix is the prefix of the names of the wait files of barriers, which keeps them apart from
+// the wait files of locks in the same Dir.
+const barrierFilePrefix = "barrier"
+
+// Barrier lets a number of parties, e.g. processes, wait for each other using wait files in Dir.
+// Once the given number of parties have arrived at the barrier, all of them proceed together.
+// Parties that arrive after that form the next generation, which waits for the same number of parties again.
+type Barrier struct {
+	Dir string
+
+	// Name identifies the barrier, so that it can share Dir with other barriers. It must not contain dashes.
+	Name string
+}
+
+// Wait blocks until the given number of parties, including this one, have arrived at the barrier.
+// If the context is cancelled while waiting, this party leaves the barrier without holding up the others,
+// unless its generation is already complete, in which case it passes the barrier as well.
+//
+// The wait files of a generation are removed once the next generation is complete,
+// so the directory keeps the wait files of the last completed generation.
+func (b *Barrier) Wait(ctx context.Context, parties int) error {
+	if parties < 1 {
+		return errors.New("a barrier needs at least one party")
+	}
+
+	co := b.derailleur()
+
+	file, err := co.createWaitFile()
+	if err != nil {
+		return err
+	}
+	file.Close()
+	filePath := file.Name()
+
+	for {
+		// Set up the watcher before checking, so that no arrival is missed in between.
+		changed := make(chan error, 1)
+		watcher := watchDir(b.Dir, changed)
+
+		passed, err := b.passed(co, filePath, parties)
+		if err != nil || passed {
+			closeWatcher(watcher)
+			return err
+		}
+
+		select {
+		case err = <-changed:
+		case <-ctx.Done():
+		}
+		closeWatcher(watcher)
+
+		if ctx.Err() != nil {
+			// The generation may have been completed along with the cancellation. Leaving it then
+			// would take away a party that the others already counted on.
+			passed, err := b.passed(co, filePath, parties)
+			if err != nil {
+				return err
+			}
+			if passed {
+				return nil
+			}
+
+			err = co.removeWaitFile(filePath)
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// derailleur returns a lock contender that manages the wait files of the barrier.
+func (b *Barrier) derailleur() *Derailleur {
+	return &Derailleur{
+		Dir:    b.Dir,
+		Prefix: barrierFilePrefix,
+		Name:   b.Name,
+	}
+}
+
+// passed reports whether the generation of the party with the wait file at filePath is complete.
+// Parties are split into generations by their position in line, so a generation is complete
+// once there are enough wait files after the start of the generation.
+func (b *Barrier) passed(co *Derailleur, filePath string, parties int) (bool, error) {
+	line, err := co.line()
+	if err != nil {
+		return false, err
+	}
+
+	position := -1
+	for i, f := range line {
+		if f == filePath {
+			position = i
+		}
+	}
+	if position < 0 {
+		// Wait files are only removed by parties of a later generation, which means this one is complete.
+		return true, nil
+	}
+
+	generation := position / parties
+	if len(line) < (generation+1)*parties {
+		return false, nil
+	}
+
+	// Remove whole earlier generations only, so that the generations of the remaining wait files don't change.
+	for _, f := range line[:generation*parties] {
+		err := co.removeWaitFile(f)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// watchDir watches the directory dir and writes nil to the channel on its first change,
+// or an error if watching fails. Exactly one value is written.
+func watchDir(dir string, channel chan error) *fsnotify.Watcher {
+	watcher, err := newWatcher([]string{dir}, defaultWatcherSetupTimeout)
+	if err != nil {
+		channel <- err
+		return nil
+	}
+
+	go func() {
+		select {
+		case _, ok := <-watcher.Events:
+			if !ok {
+				channel <- ErrWatcherClosed
+				return
+			}
+			channel <- nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				err = ErrWatcherClosed
+			}
+			channel <- err
+		}
+	}()
+
+	return watcher
+}
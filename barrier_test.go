@@ -0,0 +1,209 @@
+package derailleur
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBarrier(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	parties := 3
+	done := make(chan error)
+
+	// Two generations of parties.
+	for generation := 0; generation < 2; generation++ {
+		for i := 0; i < parties; i++ {
+			if i == parties-1 {
+				select {
+				case <-done:
+					t.Fatal("passed the barrier before all parties arrived")
+				case <-time.After(200 * time.Millisecond):
+				}
+			}
+
+			go func() {
+				barrier := Barrier{
+					Dir: dir,
+				}
+				done <- barrier.Wait(context.Background(), parties)
+			}()
+		}
+
+		for i := 0; i < parties; i++ {
+			select {
+			case <-time.After(2 * time.Second):
+				t.Fatal("Parties not passing the barrier.")
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestBarrierCancel(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	barrier := Barrier{
+		Dir: dir,
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelFn()
+
+	err = barrier.Wait(ctx, 2)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The party that left doesn't count towards the next ones.
+	done := make(chan error)
+	go func() {
+		done <- barrier.Wait(context.Background(), 2)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("passed the barrier with a party that left")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	go func() {
+		done <- barrier.Wait(context.Background(), 2)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("Parties not passing the barrier.")
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// completingContext is a context that lets the last party arrive at a barrier when it is checked for cancellation,
+// and is cancelled right after.
+type completingContext struct {
+	context.Context
+	once   sync.Once
+	arrive func()
+	cancel context.CancelFunc
+}
+
+func (c *completingContext) Done() <-chan struct{} {
+	c.once.Do(func() {
+		c.arrive()
+		c.cancel()
+	})
+	return c.Context.Done()
+}
+
+func TestBarrierCancelComplete(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	barrier := Barrier{
+		Dir: dir,
+	}
+	other := barrier.derailleur()
+
+	inner, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	ctx := &completingContext{
+		Context: inner,
+		arrive: func() {
+			file, err := other.createWaitFile()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			file.Close()
+		},
+		cancel: cancelFn,
+	}
+
+	err = barrier.Wait(ctx, 2)
+	if err != nil {
+		t.Fatalf("expected to pass the completed generation, got %v", err)
+	}
+
+	// The party stays in its generation, so the other one passes as well.
+	line, err := other.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(line) != 2 {
+		t.Fatalf("expected both wait files of the generation to be kept, got %v", line)
+	}
+}
+
+func TestBarrierSharedDir(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	barrier := Barrier{
+		Dir: dir,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- barrier.Wait(context.Background(), 2)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// A lock with the same name in the same Dir neither waits behind the barrier nor counts as a party.
+	lock := Derailleur{
+		Dir:  dir,
+		Name: "barrier",
+	}
+	acquired, err := lock.TryLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acquired {
+		t.Fatal("didn't acquire a lock that shares its name with a barrier")
+	}
+	defer lock.Release()
+
+	select {
+	case err := <-done:
+		t.Fatalf("passed the barrier with a lock contender as a party: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	go func() {
+		done <- barrier.Wait(context.Background(), 2)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("Parties not passing the barrier.")
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package derailleur
+
+import "time"
+
+// Clock tells the time that wait files are stamped with and that their age is measured against,
+// e.g. to let tests exercise TTL and aging without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the Clock that is used when none is configured. It tells the time of the system.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// clock returns the Clock of the lock contender.
+func (co *Derailleur) clock() Clock {
+	if co.Clock == nil {
+		return realClock{}
+	}
+	return co.Clock
+}
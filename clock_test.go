@@ -0,0 +1,77 @@
+package derailleur
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that starts at the time it is created and only moves when it is advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+	derailleur := Derailleur{
+		Dir:   dir,
+		Clock: clock,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	line, _, err := derailleur.find(derailleur.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := fmt.Sprintf("%019d", clock.Now().UnixNano())
+	if line[0].name.timestamp != timestamp {
+		t.Fatalf("expected the wait file to be stamped with %s, got %s", timestamp, line[0].name.timestamp)
+	}
+
+	info, err := derailleur.HolderInfo(derailleur.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.CreatedAt.Equal(clock.Now()) {
+		t.Fatalf("expected creation time %s, got %s", clock.Now(), info.CreatedAt)
+	}
+
+	clock.Advance(time.Hour)
+
+	stats, err := derailleur.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.OldestAge != time.Hour {
+		t.Fatalf("expected the oldest contender to be an hour old, got %s", stats.OldestAge)
+	}
+}
@@ -5,149 +5,1865 @@ import (
 	"errors"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
-	log "github.com/sirupsen/logrus"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+const (
+	defaultDirPerm  os.FileMode = 0755
+	defaultFilePerm os.FileMode = 0644
+
+	defaultDebounce = 10 * time.Millisecond
+
+	defaultWatcherSetupTimeout = 10 * time.Second
+)
+
+// defaultPrefix is the prefix of the names of wait files when no Prefix is configured.
+// Files in Dir that don't have the prefix are ignored when determining the order of the line.
+const defaultPrefix = "queuer"
+
+// maxCreateAttempts is how many names CreateWaitFile tries for a new wait file before giving up,
+// in case wait files with the same names are created on other hosts at the same time.
+const maxCreateAttempts = 100
+
+// Order is the order in which lock contenders get the lock.
+type Order int
+
+const (
+	// FIFO gives the lock to the contender that has been waiting the longest.
+	FIFO Order = iota
+	// LIFO gives the lock to the waiting contender that joined the line most recently once the holder releases it,
+	// which suits workloads that prefer the freshest contender, e.g. to keep caches warm.
+	// Contenders that join while the lock is held wait for it to be released like any other,
+	// and the oldest ones may wait indefinitely while new ones keep joining.
+	LIFO
+)
+
+// Mode is the way in which a lock contender holds the lock.
+type Mode int
+
+const (
+	// Exclusive holds the lock without anyone else, e.g. to write.
+	Exclusive Mode = iota
+	// Shared holds the lock together with other Shared holders, e.g. to read.
+	Shared
+)
+
+// ErrTimeout is returned by WaitInLineTimeout and AcquireDeadline when the lock isn't acquired in time.
+var ErrTimeout = errors.New("timed out waiting in line")
+
+// ErrLockLost is returned by WaitInLine when the wait file of the lock contender is removed while it is waiting,
+// e.g. by another contender cutting in line. The contender has to create a new wait file to get back in line.
+var ErrLockLost = errors.New("wait file was removed")
+
+// ErrWatcherClosed is written by WaitForFile when watching stops before the file is removed,
+// e.g. because the watcher was closed.
+var ErrWatcherClosed = errors.New("watcher closed")
+
+// ErrNotInQueue is returned when the lock contender has no wait file in line, e.g. because it was released.
+var ErrNotInQueue = errors.New("wait file not in line")
+
+// ErrWatcherSetup is returned when a watcher for waiting can't be set up in time, most commonly because
+// the limits of inotify instances or watches of the user are exhausted, e.g. fs.inotify.max_user_instances on Linux.
+// The error that is returned wraps both ErrWatcherSetup and the underlying error.
+var ErrWatcherSetup = errors.New("can't set up watcher")
+
+// ErrWatchLimitExceeded is returned when a watcher for waiting can't be set up because the inotify watches
+// of the user are exhausted, which happens with many contenders waiting in different directories or with WatchFiles.
+// The limit is raised with the fs.inotify.max_user_watches sysctl on Linux.
+// The error that is returned also matches ErrWatcherSetup.
+var ErrWatchLimitExceeded = errors.New("inotify watch limit exceeded")
+
+// ErrDirRemoved is returned by WaitInLine when Dir is removed while the contender is waiting,
+// unless RecreateDir is set. The wait files of all the contenders are gone with it.
+var ErrDirRemoved = errors.New("directory was removed")
+
+// ErrQueueFull is returned by CreateWaitFile when MaxQueueDepth contenders are already in line.
+var ErrQueueFull = errors.New("too many contenders in line")
+
+// ErrNotOSFile is returned by CreateWaitFile when FS creates files that aren't an *os.File.
+var ErrNotOSFile = errors.New("wait file isn't an *os.File")
+
 // Derailleur is a locking package that utilizes the local filesystem.
 // The main concept of Derailleur is a "wait file". Each lock contender creates a wait file
 // in order to get a place in line for the lock. The lock contender holds the lock when its
-// wait file is the first in the sorted list of files in the Dir directory. When other wait files
+// wait file is the first in the list of wait files in the Dir directory, sorted by their priorities and creation timestamps. When other wait files
 // exist before this lock contender, then it waits for the one directly preceding it to be removed.
 // By having contenders wait on only the contender before them, we avoid the thundering herd problem.
+//
+// A Derailleur may be used by several goroutines at once, but since FilePath holds only one wait file,
+// goroutines that contend for the lock concurrently should each use their own Lock from Acquire.
+// FilePath should only be accessed directly while no other goroutine is using the Derailleur.
 type Derailleur struct {
 	Dir      string
 	FilePath string
+
+	// mu guards FilePath, token, leaveGate and dirs.
+	mu    sync.Mutex
+	token uint64
+	// leaveGate lets the next InProcess contender in once the lock acquired with Lock is released.
+	leaveGate func()
+	// dirs holds Dir as it was when each wait file of the contender was created, until the contender waits in line
+	// with the wait file or removes it, so that waiting can tell a recreated Dir from a removed wait file.
+	dirs map[string]os.FileInfo
+
+	// Limit is the number of lock contenders that may hold the lock at the same time,
+	// turning the lock into a semaphore. It defaults to 1.
+	Limit int
+
+	// Order is the order in which the lock contenders get the lock. It defaults to FIFO.
+	// All contenders of a lock have to use the same Order.
+	Order Order
+
+	// Priority lets a lock contender get ahead of contenders with a higher Priority value,
+	// regardless of how long they have been waiting. 0 is the highest priority and the default.
+	// Priorities only order the contenders that are waiting: the holders of the lock stay ahead of all of them,
+	// which is why a contender with a Priority above 0 renames its wait file to mark it as held once it acquires the lock.
+	// Note that a steady stream of higher priority contenders can starve lower priority ones,
+	// which can be prevented with an AgingInterval.
+	Priority int
+
+	// AgingInterval makes the priority of waiting contenders improve by one for every AgingInterval
+	// that they have been in line, so that low priority contenders eventually get ahead of newer
+	// high priority ones. Holders aren't overtaken by contenders whose priorities improved in the meantime,
+	// since their wait files are marked as held once they acquire the lock. All contenders of a lock should use
+	// the same AgingInterval. By default, priorities don't change while waiting.
+	AgingInterval time.Duration
+
+	// Mode is whether the contender needs the lock exclusively or can share it with other Shared contenders.
+	// A Shared contender holds the lock as soon as no Exclusive contender is ahead of it in line,
+	// so consecutive Shared contenders at the front hold it together. An Exclusive contender
+	// holds the lock once it is among the first Limit contenders and no Shared contender is ahead of it.
+	// It defaults to Exclusive.
+	Mode Mode
+
+	// InProcess makes goroutines of this process that contend for the same lock in the same Dir with Lock
+	// or Acquire queue in memory first, so that no more than Limit of them wait in line with wait files at a time.
+	// This saves creating and watching files when many goroutines of one process contend,
+	// while the process still takes turns with other processes through the wait files.
+	// All contenders of the process should use the same Limit. It only applies to Exclusive contenders.
+	InProcess bool
+
+	// Sequenced orders contenders by a sequence number instead of by the wall clock time at which they joined
+	// the line, so that setting the clock back, e.g. by NTP, can't let a new contender get ahead of waiting ones.
+	// Each new wait file gets a sequence number that is higher than any one before, from a counter in Dir
+	// that is incremented by creating a file exclusively, so contenders that join at the same moment get
+	// distinct numbers and are ordered by the numbers they got. Joining the line takes two extra listings of Dir
+	// and creating and removing a small file. All contenders of a lock have to use the same setting.
+	Sequenced bool
+
+	// VerifyAcquisition makes WaitInLine list Dir a second time before acquiring the lock and keep waiting
+	// if the contender isn't at the front in that listing as well. This guards against two contenders
+	// both believing that they are first, e.g. on filesystems that don't list directories consistently,
+	// at the cost of an extra listing for every acquisition.
+	VerifyAcquisition bool
+
+	// Prefix is the prefix of the names of the wait files, so that they can be told apart from files
+	// of other tools in Dir. It must not contain path separators and defaults to "queuer".
+	// All contenders of a lock have to use the same Prefix.
+	Prefix string
+
+	// Name identifies the lock that the contender is waiting for, so that several independent
+	// locks can share one Dir. It must not contain dashes. The default lock has an empty name.
+	Name string
+
+	// Payload is application-specific data, such as a job ID, that is written into new wait files
+	// so that other processes can see what each contender represents. It never affects the order of the line.
+	// It can be read back with ReadPayload.
+	Payload []byte
+
+	// TTL is how long a wait file stays valid after it was last modified. When it is non-zero,
+	// WaitInLine removes expired wait files of other contenders instead of waiting for them.
+	// This applies to waiting contenders as well as holders, so every contender that may stay in line,
+	// waiting or holding the lock, for longer than TTL has to keep its wait file fresh with StartHeartbeat.
+	// Locks from Acquire keep their wait files fresh themselves.
+	// Otherwise other contenders remove its wait file: a waiting contender gets ErrLockLost from WaitInLine,
+	// and a holder loses the lock without being notified.
+	TTL time.Duration
+
+	// DisableAutoCreateDir makes CreateWaitFile return an error if Dir doesn't exist instead of creating it,
+	// which helps to catch a misconfigured Dir early. By default, Dir is created when it doesn't exist.
+	DisableAutoCreateDir bool
+
+	// RecreateDir makes WaitInLine get back in line with a new wait file if Dir is removed while waiting,
+	// which recreates Dir unless DisableAutoCreateDir is set. The contender joins the back of the new line.
+	// By default, WaitInLine returns ErrDirRemoved instead.
+	RecreateDir bool
+
+	// Flock makes Acquire take an exclusive advisory flock(2) on the wait file of the Lock as soon as it is created,
+	// which is held until the Lock is released, or until the process exits, on top of the order of the line.
+	// Other processes that respect flock can tell from it that the contender is still alive.
+	// It is only supported on Unix with the default FS, and like any flock it is advisory,
+	// so it protects nothing from processes that don't take it. Some network filesystems, e.g. older NFS,
+	// don't support flock at all or only within a single host. It doesn't affect Lock, which doesn't keep its wait file open.
+	Flock bool
+
+	// RecoverOwnFiles makes CreateWaitFile remove wait files of the lock that were created by a process
+	// with the same PID on the same host before creating a new one, so that a restarted process,
+	// e.g. one that always runs as PID 1 in a container, doesn't end up waiting behind its former self.
+	// It must only be used when the process has a single lock contender for the lock at a time,
+	// since the wait files of other contenders in the same process are removed as well.
+	RecoverOwnFiles bool
+
+	// MaxQueueDepth makes CreateWaitFile return ErrQueueFull instead of creating a wait file
+	// when that many contenders, including the holders, are already in line, so that services can shed load.
+	// The limit is best-effort: contenders that join at the same moment all see the line before
+	// the others' wait files exist, so the line can briefly grow beyond it. It is unlimited if zero.
+	MaxQueueDepth int
+
+	// RenameOnRelease makes the contender release a wait file by renaming it out of line first,
+	// which is atomic on the same filesystem, and only then removing it. Contenders waiting for the wait file
+	// are woken up by the rename, which helps on filesystems where removal events are less reliable.
+	RenameOnRelease bool
+
+	// DirPerm and FilePerm are the permissions of Dir and the wait files when they are created.
+	// They default to 0755 and 0644 respectively.
+	DirPerm  os.FileMode
+	FilePerm os.FileMode
+
+	// FS is the filesystem on which the wait files are kept. It defaults to the local filesystem.
+	// Note that WaitForFile only works with filesystems that fsnotify can watch,
+	// so WaitInLine needs a PollInterval for any other filesystem. Wait files of a filesystem whose files
+	// aren't an *os.File are created with CreateFSWaitFile instead of CreateWaitFile.
+	FS FS
+
+	// Clock tells the time that wait files are stamped with and that their age is measured against.
+	// It defaults to the time of the system. Wait files created in the process should be stamped with increasing times,
+	// or they may not be queued in the order in which they were created.
+	Clock Clock
+
+	// WatchFiles makes waiting on Linux watch the wait files themselves instead of their directory,
+	// which spares waiters the events of all the other files in a busy directory. Inotify only reports
+	// the removal of a watched file once no process has it open anymore, though, e.g. the wait file of a Lock
+	// that was cut in line while it is held, so a removal may be noticed late. It is ignored on other platforms,
+	// where files are always watched themselves, except on Windows, where directories are.
+	WatchFiles bool
+
+	// PollInterval makes WaitInLine check the line periodically instead of watching for changes with fsnotify,
+	// which is unreliable on some filesystems, e.g. NFS. By default, changes are watched for,
+	// with one watcher for each directory that is shared by all the contenders of the process that wait in it.
+	PollInterval time.Duration
+
+	// Debounce is how long WaitForFile keeps collecting changes after a wait file is removed,
+	// so that a burst of removals causes a single check of the line instead of one for each removal.
+	// It defaults to 10ms, and a negative value wakes up on the first removal right away.
+	Debounce time.Duration
+
+	// WatcherSetupTimeout bounds how long setting up a watcher may take before waiting fails with ErrWatcherSetup,
+	// since it can hang on some container runtimes when inotify instances are exhausted. It defaults to 10 seconds.
+	WatcherSetupTimeout time.Duration
+
+	// WatcherErrors receives the errors reported by watchers while waiting, e.g. an overflow of the inotify event queue,
+	// if it is set. Such errors are then not terminal: waiting goes on, checking the line again in case events were lost.
+	// Errors are dropped if the channel isn't ready to receive them, so that waiting is never blocked on it.
+	WatcherErrors chan<- error
+
+	// Retry is how filesystem operations are retried when they fail with transient errors,
+	// e.g. a stale NFS file handle. By default, they aren't retried.
+	Retry RetryPolicy
+
+	// Logger receives messages about the progress of the lock contender. Nothing is logged by default.
+	Logger Logger
+
+	// Verbose enables logging a message every time the contender checks the line while waiting,
+	// which is useful for debugging but too noisy for deployments with many acquisitions.
+	Verbose bool
+
+	// Metrics receives measurements of waiting for and holding the lock. Nothing is measured by default.
+	Metrics Metrics
+
+	// OnEnqueue, OnAdvance, OnAcquire and OnRelease are called on the lifecycle events of the contender's wait files
+	// if they are set: when a wait file is created, when its position in line changes while waiting,
+	// when the lock is acquired, and when it is released. They are called synchronously, so they must not block.
+	OnEnqueue func(filePath string)
+	OnAdvance func(position int)
+	OnAcquire func()
+	OnRelease func()
+}
+
+// Coordinator is the name under which Derailleur was known when the package was called coordination.
+// It is kept as an alias so that code written against that name still compiles.
+//
+// Deprecated: Use Derailleur instead.
+type Coordinator = Derailleur
+
+// New returns a Derailleur for the line in dir, creating the directory if it doesn't exist yet.
+func New(dir string) (*Derailleur, error) {
+	if dir == "" {
+		return nil, errors.New("derailleur: empty directory")
+	}
+
+	co := &Derailleur{
+		Dir: dir,
+	}
+
+	err := co.fs().MkdirAll(dir, co.dirPerm())
+	if err != nil {
+		return nil, err
+	}
+
+	return co, nil
 }
 
 // WaitForFile watches the file at filePath and waits for it to be removed.
-// It writes nil to the channel when the file is removed or an error.
+// It writes nil to the channel when the file is removed or an error if watching fails,
+// including ErrWatcherClosed when the returned watcher is closed before the file is removed.
+// The returned watcher is nil if it couldn't be set up, in which case an error matching ErrWatcherSetup is written.
+// Exactly one value is written, after which the watching goroutine exits,
+// so callers that may stop listening before that should pass a buffered channel.
 func (co *Derailleur) WaitForFile(filePath string, channel chan error) *fsnotify.Watcher {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
+	return co.watchFiles(context.Background(), []string{filePath}, channel)
+}
+
+// WaitForFileContext is like WaitForFile, but the watching goroutine also exits when the context is cancelled,
+// after writing the error of the context to the channel. The returned watcher still has to be closed
+// to release its resources.
+func (co *Derailleur) WaitForFileContext(ctx context.Context, filePath string, channel chan error) *fsnotify.Watcher {
+	return co.watchFiles(ctx, []string{filePath}, channel)
+}
+
+// WaitForFileFunc is like WaitForFileContext, but waits for an event on the file at filePath for which match
+// returns true instead of its removal, e.g. to wait for the file to be written. The Name of the events is filePath.
+// Unlike with removals, an event that happens before the watch is set up is missed.
+func (co *Derailleur) WaitForFileFunc(ctx context.Context, filePath string, match func(fsnotify.Event) bool, channel chan error) *fsnotify.Watcher {
+	return co.watch(ctx, []string{filePath}, match, func(_ string, err error) {
 		channel <- err
-		return watcher
+	})
+}
+
+// watchFiles is like WaitForFileContext, but waits for any of the files at filePaths to be removed.
+func (co *Derailleur) watchFiles(ctx context.Context, filePaths []string, channel chan error) *fsnotify.Watcher {
+	return co.watch(ctx, filePaths, nil, func(_ string, err error) {
+		channel <- err
+	})
+}
+
+// WaitForAny blocks until any of the files at filePaths is removed and returns its path.
+// All files share one watcher, which watches each parent directory only once where directories are watched.
+func (co *Derailleur) WaitForAny(ctx context.Context, filePaths []string) (string, error) {
+	type result struct {
+		filePath string
+		err      error
 	}
+	results := make(chan result, 1)
 
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if event.Name != filePath {
-					continue
-				}
-				if !ok {
-					channel <- errors.New("fsnotify channel closed abruptly")
-				}
-				if event.Op&fsnotify.Remove == fsnotify.Remove {
-					channel <- nil
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					channel <- err
-				}
+	watcher := co.watch(ctx, filePaths, nil, func(filePath string, err error) {
+		results <- result{filePath, err}
+	})
+	if watcher != nil {
+		defer watcher.Close()
+	}
+
+	r := <-results
+	return r.filePath, r.err
+}
+
+// WaitForAll blocks until all of the files at filePaths are removed, e.g. the wait files of a known set of workers.
+// Like WaitForAny, it uses one watcher for all files at a time, which watches each parent directory only once.
+func (co *Derailleur) WaitForAll(ctx context.Context, filePaths []string) error {
+	remaining := append([]string(nil), filePaths...)
+
+	for len(remaining) > 0 {
+		removed, err := co.WaitForAny(ctx, remaining)
+		if err != nil {
+			return err
+		}
+
+		for i, filePath := range remaining {
+			if filePath == removed {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
 			}
 		}
-	}()
+	}
 
-	// When using kqueue you can receive REMOVE events by watching
-	// the removed file itself, but inotify doesn't seem to work that
-	// way, so when running on Linux I'm watching the parent dir instead.
-	if runtime.GOOS == "linux" {
-		err = watcher.Add(filepath.Dir(filePath))
-	} else {
-		err = watcher.Add(filePath)
+	return nil
+}
+
+// watch watches the files at filePaths and calls report exactly once, either with the path of the first one
+// that is removed or with an error if watching fails or the context is cancelled.
+// If match isn't nil, it decides which events on the files count instead of their removal.
+func (co *Derailleur) watch(ctx context.Context, filePaths []string, match func(fsnotify.Event) bool, report func(filePath string, err error)) *fsnotify.Watcher {
+	watched, targets, err := watchTargets(filePaths, co.WatchFiles)
+	if err != nil {
+		// There is nothing to watch, but callers still get a watcher to close, as for any other failure to watch.
+		watcher, _ := newWatcher(nil, co.watcherSetupTimeout())
+		go report("", err)
+		return watcher
 	}
+
+	watcher, err := newWatcher(targets, co.watcherSetupTimeout())
 	if err != nil {
-		channel <- err
+		go report("", err)
+		return nil
 	}
 
+	go co.watchEvents(ctx, watcher.Events, watcher.Errors, watched, match, report)
+
 	return watcher
 }
 
-// CreateWaitFile creates a file which is used by a lock contender to hold a place in line for the lock.
-// Each file name has a timestamp of when it was created and an additional random suffix to avoid races.
-func (co *Derailleur) CreateWaitFile() (*os.File, error) {
-	namePattern := fmt.Sprintf("queuer-%d-*", time.Now().UnixNano())
-	err := os.MkdirAll(co.Dir, os.ModePerm)
+// watchShared is like watch, but uses the watchers that are shared by the waiters of the process instead of a new one,
+// and waits for removals. Watching stops once the returned function is called.
+func (co *Derailleur) watchShared(ctx context.Context, filePaths []string, report func(filePath string, err error)) func() {
+	watched, targets, err := watchTargets(filePaths, co.WatchFiles)
 	if err != nil {
-		return nil, err
+		go report("", err)
+		return func() {}
 	}
 
-	file, err := ioutil.TempFile(co.Dir, namePattern)
+	sub, err := subscribeWatches(targets, co.watcherSetupTimeout())
 	if err != nil {
-		return nil, err
+		go report("", err)
+		return func() {}
 	}
-	co.FilePath = file.Name()
 
-	return file, nil
+	go co.watchEvents(ctx, sub.events, sub.errors, watched, nil, report)
+
+	return sub.unsubscribe
 }
 
-// WaitInLine blocks until the lock contender is the first in line.
-func (co *Derailleur) WaitInLine(ctx context.Context) {
-	for {
-		files, err := os.ReadDir(co.Dir)
-		if err != nil {
-			log.Fatal(err)
+// watchTargets returns what has to be watched to notice the removal of the files at filePaths.
+// watched maps the paths of the files with symbolic links in their directories resolved to the paths they were given with,
+// and targets are the paths to add to a watcher. On Linux, the files themselves are watched if watchFiles is set.
+func watchTargets(filePaths []string, watchFiles bool) (watched map[string]string, targets []string, err error) {
+	// resolved caches the parent directories of the watched files with symbolic links resolved.
+	resolved := make(map[string]string)
+
+	// Events name files by the paths that are watched, which are the resolved ones,
+	// and with the separators of the platform, which wait file paths may not use.
+	watched = make(map[string]string, len(filePaths))
+	for _, filePath := range filePaths {
+		if filePath == "" {
+			return nil, nil, errors.New("can't watch an empty file path")
+		}
+
+		dir := filepath.Dir(filePath)
+		if _, ok := resolved[dir]; !ok {
+			resolvedDir, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				// Leave it to watching to report a missing directory.
+				resolvedDir = filepath.Clean(dir)
+			}
+			resolved[dir] = resolvedDir
+		}
+		watched[filepath.Join(resolved[dir], filepath.Base(filePath))] = filePath
+	}
+
+	// When using kqueue you can receive REMOVE events by watching
+	// the removed file itself, but inotify doesn't seem to work that
+	// way, so when running on Linux I'm watching the parent dir instead.
+	// Watching files directly isn't reliable with ReadDirectoryChangesW on Windows either.
+	// Inotify does report IN_DELETE_SELF for a watched file, but only once the file isn't open anywhere anymore.
+	added := make(map[string]bool)
+	for target := range watched {
+		if runtime.GOOS == "linux" && !watchFiles || runtime.GOOS == "windows" {
+			target = filepath.Dir(target)
+		}
+		if added[target] {
+			continue
 		}
+		added[target] = true
+		targets = append(targets, target)
+	}
+
+	return watched, targets, nil
+}
+
+// watchEvents calls report exactly once with the path of the first watched file that is removed,
+// or that an event matches if match isn't nil, or with an error if watching fails or the context is cancelled.
+// Watching stops when the channels of events and errors are closed.
+func (co *Derailleur) watchEvents(ctx context.Context, events <-chan fsnotify.Event, errs <-chan error,
+	watched map[string]string, match func(fsnotify.Event) bool, report func(filePath string, err error)) {
+	// Removals can be noticed after the fact, which is why only they are checked for outside of events.
+	removals := match == nil
+	if removals {
+		match = isRemoval
+	}
 
-		var toWatch string
+	// A file that was removed before the watch was set up wouldn't produce an event.
+	if removals {
+		if filePath, ok := co.firstRemoved(watched); ok {
+			report(filePath, nil)
+			return
+		}
+	}
 
-		for i, f := range files {
-			if path.Join(co.Dir, f.Name()) != co.FilePath {
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				report("", ErrWatcherClosed)
+				return
+			}
+			filePath, ok := watched[filepath.Clean(event.Name)]
+			if !ok {
 				continue
 			}
-			if i == 0 {
-				log.Info("First in line.")
+			event.Name = filePath
+			if match(event) {
+				co.settle(events, errs)
+				report(filePath, nil)
+				return
+			}
+		case err, ok := <-errs:
+			if !ok {
+				report("", ErrWatcherClosed)
+				return
+			}
+			if errors.Is(err, errEventsDropped) {
+				// Events of a shared watcher were dropped, so look for removed files again.
+				if removals {
+					if filePath, ok := co.firstRemoved(watched); ok {
+						report(filePath, nil)
+						return
+					}
+				}
+				continue
+			}
+			if co.WatcherErrors == nil {
+				report("", err)
+				return
+			}
+			co.forwardWatcherError(err)
+
+			// The error may have cost events, e.g. on an overflow, so look for removed files again.
+			if removals {
+				if filePath, ok := co.firstRemoved(watched); ok {
+					report(filePath, nil)
+					return
+				}
+			}
+		case <-ctx.Done():
+			report("", ctx.Err())
+			return
+		}
+	}
+}
+
+// isRemoval reports whether the event removes the file. A file that is renamed, e.g. by Downgrade,
+// is gone from the watched path just the same.
+func isRemoval(event fsnotify.Event) bool {
+	return event.Op&(fsnotify.Remove|fsnotify.Rename) != 0
+}
+
+// firstRemoved returns the original path of one of the watched files that no longer exists, if any.
+func (co *Derailleur) firstRemoved(watched map[string]string) (string, bool) {
+	for _, filePath := range watched {
+		_, err := co.fs().Stat(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return filePath, true
+		}
+	}
+	return "", false
+}
+
+// forwardWatcherError sends err to WatcherErrors without blocking.
+func (co *Derailleur) forwardWatcherError(err error) {
+	co.logger().Errorf("watcher error: %v", err)
+
+	select {
+	case co.WatcherErrors <- err:
+	default:
+	}
+}
+
+// watcherSetupError is returned when a watcher can't be set up. It matches ErrWatcherSetup and wraps the cause.
+// It also matches ErrWatchLimitExceeded if a watch couldn't be added because there are too many already.
+type watcherSetupError struct {
+	err error
+}
+
+func (e watcherSetupError) Error() string {
+	if e.watchLimitExceeded() {
+		return fmt.Sprintf("%v: %v: %v (raise the fs.inotify.max_user_watches sysctl)", ErrWatcherSetup, ErrWatchLimitExceeded, e.err)
+	}
+	return fmt.Sprintf("%v: %v", ErrWatcherSetup, e.err)
+}
+
+func (e watcherSetupError) Unwrap() error {
+	return e.err
+}
+
+func (e watcherSetupError) Is(target error) bool {
+	return target == ErrWatcherSetup || target == ErrWatchLimitExceeded && e.watchLimitExceeded()
+}
+
+// watchLimitExceeded reports whether the watcher couldn't be set up because inotify watches are exhausted,
+// which inotify reports as ENOSPC.
+func (e watcherSetupError) watchLimitExceeded() bool {
+	return errors.Is(e.err, syscall.ENOSPC)
+}
+
+// newWatcher creates a watcher that watches the targets, giving up after timeout.
+// Targets that don't exist are skipped, since the files were removed before they could be watched.
+// A watcher whose setup completes after the timeout is closed right away.
+func newWatcher(targets []string, timeout time.Duration) (*fsnotify.Watcher, error) {
+	type result struct {
+		watcher *fsnotify.Watcher
+		err     error
+	}
+	created := make(chan result, 1)
+
+	go func() {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			created <- result{nil, err}
+			return
+		}
+
+		for _, target := range targets {
+			err = watcher.Add(target)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				watcher.Close()
+				created <- result{nil, err}
 				return
 			}
+		}
+
+		created <- result{watcher, nil}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-			toWatch = path.Join(co.Dir, files[i-1].Name())
+	select {
+	case r := <-created:
+		if r.err != nil {
+			return nil, watcherSetupError{r.err}
 		}
+		return r.watcher, nil
+	case <-timer.C:
+		go func() {
+			r := <-created
+			if r.watcher != nil {
+				r.watcher.Close()
+			}
+		}()
+		return nil, watcherSetupError{fmt.Errorf("timed out after %s", timeout)}
+	}
+}
+
+// closeWatcher closes the watcher unless it couldn't be set up.
+func closeWatcher(watcher *fsnotify.Watcher) {
+	if watcher != nil {
+		watcher.Close()
+	}
+}
 
-		log.Infof("Waiting for queuer with file %s to exit.", toWatch)
+// settle discards the events of a watcher for the Debounce window,
+// so that a burst of removals results in a single wakeup.
+func (co *Derailleur) settle(events <-chan fsnotify.Event, errs <-chan error) {
+	window := co.debounce()
+	if window <= 0 {
+		return
+	}
 
-		watchChan := make(chan error)
-		watcher := co.WaitForFile(toWatch, watchChan)
+	timer := time.NewTimer(window)
+	defer timer.Stop()
 
+	for {
 		select {
-		case err := <-watchChan:
-			if err != nil {
-				log.Fatal(err)
+		case _, ok := <-events:
+			if !ok {
+				return
 			}
-			break
-		case <-ctx.Done():
+		case _, ok := <-errs:
+			if !ok {
+				return
+			}
+		case <-timer.C:
 			return
 		}
+	}
+}
 
-		watcher.Close()
+func (co *Derailleur) filePath() string {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.FilePath
+}
+
+func (co *Derailleur) setFilePath(filePath string) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.FilePath = filePath
+}
+
+// clearFilePath clears FilePath unless it was changed to another wait file in the meantime.
+func (co *Derailleur) clearFilePath(filePath string) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if co.FilePath == filePath {
+		co.FilePath = ""
 	}
 }
 
-// CutInLine forcibly removes the current lock holder and preceding lock contenders
-// and makes the current contender acquire the lock.
-// Note that this does not affect contenders that succeed the current contender in the line.
-func (co *Derailleur) CutInLine() error {
-	files, err := os.ReadDir(co.Dir)
+func (co *Derailleur) watcherSetupTimeout() time.Duration {
+	if co.WatcherSetupTimeout <= 0 {
+		return defaultWatcherSetupTimeout
+	}
+	return co.WatcherSetupTimeout
+}
+
+func (co *Derailleur) limit() int {
+	if co.Limit < 1 {
+		return 1
+	}
+	return co.Limit
+}
+
+func (co *Derailleur) debounce() time.Duration {
+	if co.Debounce == 0 {
+		return defaultDebounce
+	}
+	return co.Debounce
+}
+
+func (co *Derailleur) prefix() string {
+	if co.Prefix == "" {
+		return defaultPrefix
+	}
+	return co.Prefix
+}
+
+func (co *Derailleur) dirPerm() os.FileMode {
+	if co.DirPerm == 0 {
+		return defaultDirPerm
+	}
+	return co.DirPerm
+}
+
+func (co *Derailleur) filePerm() os.FileMode {
+	if co.FilePerm == 0 {
+		return defaultFilePerm
+	}
+	return co.FilePerm
+}
+
+// CreateWaitFile creates a file which is used by a lock contender to hold a place in line for the lock.
+// Each file name has the name of the lock, the mode and the priority of the contender, a timestamp of when it was created,
+// a sequence number that orders the wait files of one process with the same timestamp
+// and the PID of the process. The file is created exclusively, so a name that is already taken,
+// e.g. by a process on another host, is never reused.
+// The file contains information about the process that created it, which can be read back with HolderInfo.
+// It returns ErrNotOSFile if FS creates files that aren't an *os.File, in which case CreateFSWaitFile has to be used.
+func (co *Derailleur) CreateWaitFile() (*os.File, error) {
+	file, err := co.createWaitFile()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	osFile, err := co.osFile(file)
+	if err != nil {
+		return nil, err
 	}
+	co.setFilePath(osFile.Name())
 
-	for _, f := range files {
-		currentFileName := path.Join(co.Dir, f.Name())
-		if currentFileName == co.FilePath {
-			break
+	return osFile, nil
+}
+
+// CreateFSWaitFile is like CreateWaitFile, but returns the wait file as a File, so that it works with any FS.
+func (co *Derailleur) CreateFSWaitFile() (File, error) {
+	file, err := co.createWaitFile()
+	if err != nil {
+		return nil, err
+	}
+	co.setFilePath(file.Name())
+
+	return file, nil
+}
+
+// CreateWaitFileContext is like CreateWaitFile, but stops waiting for the filesystem once the context is cancelled,
+// e.g. when Dir is on a network mount that hangs. A wait file that is created after that is removed again.
+func (co *Derailleur) CreateWaitFileContext(ctx context.Context) (*os.File, error) {
+	type result struct {
+		file File
+		err  error
+	}
+	created := make(chan result, 1)
+
+	go func() {
+		file, err := co.createWaitFile()
+		created <- result{file, err}
+	}()
+
+	select {
+	case r := <-created:
+		if r.err != nil {
+			return nil, r.err
 		}
-		err := os.Remove(currentFileName)
+		osFile, err := co.osFile(r.file)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		co.setFilePath(osFile.Name())
+		return osFile, nil
+	case <-ctx.Done():
+		// Clean up the wait file whenever the filesystem gets to it, so that it doesn't block the line.
+		go func() {
+			r := <-created
+			if r.err == nil {
+				r.file.Close()
+				_ = co.removeWaitFile(r.file.Name())
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// osFile returns the new wait file as an *os.File. If FS created it as another kind of File,
+// the wait file is removed again, so that it doesn't take a place in line.
+func (co *Derailleur) osFile(file File) (*os.File, error) {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		file.Close()
+		err := co.removeWaitFile(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrNotOSFile
+	}
+	return osFile, nil
+}
+
+// createWaitFile creates a new wait file with the Payload without making it the wait file of the lock contender.
+func (co *Derailleur) createWaitFile() (File, error) {
+	return co.createWaitFileWithPayload(co.Payload)
+}
+
+// createWaitFileWithPayload creates a new wait file with the given payload
+// without making it the wait file of the lock contender.
+func (co *Derailleur) createWaitFileWithPayload(payload []byte) (File, error) {
+	err := validateName(co.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = validatePriority(co.Priority)
+	if err != nil {
+		return nil, err
+	}
+	err = validatePrefix(co.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if co.DisableAutoCreateDir {
+		_, err = co.fs().Stat(co.Dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("directory %s doesn't exist: %w", co.Dir, os.ErrNotExist)
+		}
+	} else {
+		err = co.fs().MkdirAll(co.Dir, co.dirPerm())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if co.RecoverOwnFiles {
+		err = co.recoverOwnFiles()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if co.MaxQueueDepth > 0 {
+		line, err := co.waitFiles()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) >= co.MaxQueueDepth {
+			return nil, ErrQueueFull
+		}
+	}
+
+	var file File
+	for attempt := 1; ; attempt++ {
+		file, err = co.createNamedWaitFile()
+		if errors.Is(err, fs.ErrExist) && attempt < maxCreateAttempts {
+			// Another host created a wait file with the same name. The next name gets a new timestamp.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	err = file.Chmod(co.filePerm())
+	if err == nil {
+		err = writeHolderInfo(file, co.clock().Now(), payload)
+	}
+	if err != nil {
+		file.Close()
+		_ = co.fs().Remove(file.Name())
+		return nil, err
+	}
+
+	co.setCreatedDir(file.Name())
+
+	if co.OnEnqueue != nil {
+		co.OnEnqueue(file.Name())
+	}
+
+	return file, nil
+}
+
+// setCreatedDir records Dir as it is right after the wait file at filePath was created.
+func (co *Derailleur) setCreatedDir(filePath string) {
+	dir, err := co.fs().Stat(co.Dir)
+	if err != nil {
+		return
+	}
+
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if co.dirs == nil {
+		co.dirs = map[string]os.FileInfo{}
+	}
+	co.dirs[filePath] = dir
+}
+
+// takeCreatedDir returns Dir as it was when the wait file at filePath was created and forgets it,
+// or nil if it is unknown, e.g. because FilePath was set directly.
+func (co *Derailleur) takeCreatedDir(filePath string) os.FileInfo {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	dir := co.dirs[filePath]
+	delete(co.dirs, filePath)
+	return dir
+}
+
+// createNamedWaitFile creates a wait file with a new name. Naming and creating wait files is serialized
+// within the process, so that no wait file of the process is created after one with a later timestamp.
+// Otherwise, a contender could acquire the lock while a wait file that sorts ahead of its own is yet to be created.
+func (co *Derailleur) createNamedWaitFile() (File, error) {
+	createMu.Lock()
+	defer createMu.Unlock()
+
+	name, err := co.newWaitFileName()
+	if err != nil {
+		return nil, err
+	}
+
+	return co.fs().CreateExclusive(path.Join(co.Dir, name))
+}
+
+// line returns the paths of the wait files of the lock in Dir in the order in which their lock contenders are queued.
+func (co *Derailleur) line() ([]string, error) {
+	waitFiles, err := co.waitFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	line := make([]string, len(waitFiles))
+	for i, f := range waitFiles {
+		line[i] = f.path
+	}
+
+	return line, nil
+}
+
+// waitFiles is like line, but returns the wait files with their parsed names.
+func (co *Derailleur) waitFiles() ([]waitFile, error) {
+	var files []fs.DirEntry
+	err := co.retry(func() error {
+		var err error
+		files, err = co.fs().ReadDir(co.Dir)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var waitFiles []waitFile
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name, ok := parseWaitFileName(co.prefix(), f.Name())
+		if !ok || name.lock != co.Name {
+			continue
+		}
+		waitFiles = append(waitFiles, waitFile{path.Join(co.Dir, f.Name()), name})
+	}
+	co.ordering().sort(waitFiles)
+
+	return waitFiles, nil
+}
+
+// ordering returns how the lock contender sorts the wait files of its line.
+func (co *Derailleur) ordering() ordering {
+	return ordering{order: co.Order, agingInterval: co.AgingInterval, now: co.clock().Now(), sequenced: co.Sequenced}
+}
+
+// blockers returns the paths of the wait files that the contender at index i of the line is waiting for
+// to be removed, or nil if it holds the lock.
+func (co *Derailleur) blockers(line []waitFile, i int) []string {
+	var blockers []string
+
+	if line[i].name.mode == Shared {
+		// Every Exclusive contender ahead has to exit first.
+		for _, f := range line[:i] {
+			if f.name.mode == Exclusive {
+				blockers = append(blockers, f.path)
+			}
+		}
+		return blockers
+	}
+
+	if i >= co.limit() {
+		// A slot opens up once the contender Limit places ahead exits.
+		return []string{line[i-co.limit()].path}
+	}
+
+	// Shared holders ahead have to exit before the lock can be held exclusively.
+	for _, f := range line[:i] {
+		if f.name.mode == Shared {
+			blockers = append(blockers, f.path)
+		}
+	}
+	return blockers
+}
+
+// holds reports whether the lock contender with the wait file at filePath currently holds the lock.
+func (co *Derailleur) holds(filePath string) (bool, error) {
+	line, err := co.waitFiles()
+	if err != nil {
+		return false, err
+	}
+
+	for i, f := range line {
+		if f.path == filePath {
+			return len(co.blockers(line, i)) == 0, nil
+		}
+	}
+
+	return false, fmt.Errorf("%w: %s not found in %s", ErrNotInQueue, filePath, co.Dir)
+}
+
+// Release removes the wait file of the lock contender, giving up its place in line
+// or the lock itself if it was being held. A wait file that was already removed is not an error.
+// It clears FilePath, so the Derailleur can be reused right away: CreateWaitFile, WaitInLine and Release
+// can be called again in that order for every acquisition, as Lock and Release do.
+func (co *Derailleur) Release() error {
+	err := co.leaveLine()
+	if err != nil {
+		return err
+	}
+	co.metrics().IncReleased()
+	if co.OnRelease != nil {
+		co.OnRelease()
+	}
+
+	co.mu.Lock()
+	leaveGate := co.leaveGate
+	co.leaveGate = nil
+	co.mu.Unlock()
+	if leaveGate != nil {
+		leaveGate()
+	}
+
+	return nil
+}
+
+// Abandon removes the wait file of the lock contender to leave the line without having acquired the lock,
+// e.g. when the contender decides to stop waiting. It does the same as Release, but is reported as giving up
+// rather than releasing the lock. A wait file that was already removed is not an error.
+func (co *Derailleur) Abandon() error {
+	err := co.leaveLine()
+	if err != nil {
+		return err
+	}
+	co.logger().Infof("Left the line without acquiring the lock.")
+
+	return nil
+}
+
+// Reset makes the lock contender forget its wait file without removing it, e.g. after WaitInLine returned
+// ErrLockLost, so that the Derailleur can be reused for a new acquisition. It isn't needed after Release or Abandon,
+// which clear FilePath themselves. A wait file that still exists keeps its place in line until it is removed
+// some other way, so Release should be used to leave the line instead.
+// Other InProcess contenders are let in as if the lock was released.
+func (co *Derailleur) Reset() {
+	co.mu.Lock()
+	co.FilePath = ""
+	leaveGate := co.leaveGate
+	co.leaveGate = nil
+	co.mu.Unlock()
+
+	if leaveGate != nil {
+		leaveGate()
+	}
+}
+
+// leaveLine removes the wait file of the lock contender and clears FilePath.
+func (co *Derailleur) leaveLine() error {
+	filePath := co.filePath()
+	err := co.removeWaitFile(filePath)
+	if err != nil {
+		return err
+	}
+	co.clearFilePath(filePath)
+
+	return nil
+}
+
+// removeWaitFileContext is like removeWaitFile, but stops waiting for the filesystem once the context is done.
+func (co *Derailleur) removeWaitFileContext(ctx context.Context, filePath string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- co.removeWaitFile(filePath)
+	}()
+
+	select {
+	case err := <-removed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// removeWaitFile removes the wait file at filePath. A wait file that was already removed is not an error.
+func (co *Derailleur) removeWaitFile(filePath string) error {
+	_, err := co.removeWaitFileIfPresent(filePath)
+	return err
+}
+
+// removeWaitFileIfPresent is like removeWaitFile, but also reports whether the wait file was still in line,
+// so that callers can count the wait files that they took out of line themselves.
+func (co *Derailleur) removeWaitFileIfPresent(filePath string) (bool, error) {
+	co.takeCreatedDir(filePath)
+
+	if co.RenameOnRelease {
+		releasing := filePath + releasingSuffix
+		err := co.retry(func() error {
+			return co.fs().Rename(filePath, releasing)
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		// The wait file is out of line now, so failing to remove it leaves nothing but clutter behind.
+		filePath = releasing
+	}
+
+	err := co.retry(func() error {
+		return co.fs().Remove(filePath)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return co.RenameOnRelease, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WaitInLine blocks until the lock contender is the first in line,
+// or among the first Limit contenders if more than one holder is allowed.
+// It returns nil once the lock is acquired, ErrLockLost if the wait file of the contender is removed,
+// ErrDirRemoved if Dir is removed and RecreateDir isn't set, ErrNotInQueue if the contender has no wait file,
+// or an error if the directory can't be read or watching the preceding wait file fails.
+// If the context is cancelled while waiting, the wait file of the contender is removed.
+// A contender that is already first in line returns after listing the line once, without setting up a watcher.
+func (co *Derailleur) WaitInLine(ctx context.Context) error {
+	filePath := co.filePath()
+	if filePath == "" {
+		return ErrNotInQueue
+	}
+
+	current, err := co.waitInLine(ctx, filePath, func() (string, error) {
+		file, err := co.createWaitFile()
+		if err != nil {
+			return "", err
+		}
+		file.Close()
+		return file.Name(), nil
+	})
+	if err != nil && err == ctx.Err() {
+		co.clearFilePath(filePath)
+	} else if current != filePath {
+		co.setFilePath(current)
+	}
+
+	return err
+}
+
+// waitInLine blocks until the lock contender with the wait file at filePath holds the lock.
+// If the context is cancelled while waiting, the wait file is removed.
+// It returns the path of the wait file of the contender, which changes if Dir is recreated with RecreateDir,
+// in which case recreate is called to create a new wait file and return its path.
+func (co *Derailleur) waitInLine(ctx context.Context, filePath string, recreate func() (string, error)) (string, error) {
+	start := time.Now()
+	position := -1
+	// Dir was looked up when the wait file was created, so that an uncontended acquisition takes a single listing.
+	// Otherwise, it is only looked up once the contender has to wait.
+	dir := co.takeCreatedDir(filePath)
+
+	for {
+		if co.TTL > 0 {
+			_, err := co.reapExpired(filePath)
+			// A missing Dir is handled along with listing the line.
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return filePath, err
+			}
+		}
+
+		line, err := co.waitFiles()
+		if errors.Is(err, os.ErrNotExist) && co.dirRemoved(dir) {
+			filePath, dir, err = co.requeue(filePath, recreate)
+			if err != nil {
+				return filePath, err
+			}
+			position = -1
+			continue
+		}
+		if err != nil {
+			return filePath, err
+		}
+		co.metrics().SetQueueDepth(len(line))
+
+		var toWatch []string
+		var ahead []string
+
+		found := false
+		for i, f := range line {
+			if f.path != filePath {
+				continue
+			}
+			found = true
+
+			if i != position {
+				position = i
+				if co.OnAdvance != nil {
+					co.OnAdvance(position)
+				}
+			}
+
+			toWatch = co.blockers(line, i)
+			if len(toWatch) == 0 && co.VerifyAcquisition {
+				// Confirm the place in line with a second listing, in case the first one missed a contender ahead.
+				verified, j, err := co.find(filePath)
+				if errors.Is(err, ErrNotInQueue) {
+					return filePath, ErrLockLost
+				}
+				if err != nil {
+					return filePath, err
+				}
+				line, i = verified, j
+				toWatch = co.blockers(line, i)
+			}
+			if len(toWatch) == 0 && co.pinsHeld() && !line[i].name.held {
+				// Mark the wait file, so that waiting contenders that sort before it can't get ahead of it.
+				filePath, toWatch, err = co.markHeld(filePath)
+				if err != nil {
+					return filePath, err
+				}
+			}
+			if len(toWatch) == 0 {
+				co.verbosef("First in line.")
+				co.metrics().ObserveWaitDuration(time.Since(start))
+				co.metrics().IncAcquired()
+				if co.OnAcquire != nil {
+					co.OnAcquire()
+				}
+				return filePath, nil
+			}
+
+			for _, f := range line[:i] {
+				ahead = append(ahead, f.path)
+			}
+			break
+		}
+
+		if !found {
+			if !co.dirRemoved(dir) {
+				return filePath, ErrLockLost
+			}
+			filePath, dir, err = co.requeue(filePath, recreate)
+			if err != nil {
+				return filePath, err
+			}
+			position = -1
+			continue
+		}
+
+		co.verbosef("Waiting for queuer with file %s to exit.", strings.Join(toWatch, ", "))
+
+		if dir == nil {
+			dir, _ = co.fs().Stat(co.Dir)
+		}
+
+		// Watch the own wait file as well to notice when it gets removed.
+		err = co.waitForTurn(ctx, append(toWatch, filePath), ahead)
+		if ctx.Err() != nil {
+			// Leave the line so that contenders behind us aren't blocked forever.
+			err := co.removeWaitFile(filePath)
+			if err != nil {
+				return filePath, err
+			}
+			return filePath, ctx.Err()
+		}
+		if err != nil {
+			return filePath, err
+		}
+	}
+}
+
+// dirRemoved reports whether Dir was removed since dir was obtained from it, including when another contender
+// has already recreated it in the meantime.
+func (co *Derailleur) dirRemoved(dir os.FileInfo) bool {
+	info, err := co.fs().Stat(co.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	if err != nil || dir == nil {
+		return false
+	}
+	// Only the files of the local filesystem can be told apart, for which a file is always the same as itself.
+	return os.SameFile(dir, dir) && !os.SameFile(dir, info)
+}
+
+// requeue gets the contender with the wait file at filePath back in line after Dir was removed
+// by creating a new wait file with recreate if RecreateDir is set. It returns the path of the new wait file and Dir.
+// Otherwise, it returns ErrDirRemoved.
+func (co *Derailleur) requeue(filePath string, recreate func() (string, error)) (string, os.FileInfo, error) {
+	if !co.RecreateDir {
+		return filePath, nil, ErrDirRemoved
+	}
+
+	newPath, err := recreate()
+	if err != nil {
+		return filePath, nil, err
+	}
+	co.logger().Errorf("Directory %s was removed, queued again with wait file %s.", co.Dir, newPath)
+
+	dir, _ := co.fs().Stat(co.Dir)
+	return newPath, dir, nil
+}
+
+// pinsHeld reports whether contenders that are still waiting can sort before the contender once it holds the lock,
+// which is the case if it doesn't have the highest priority, if the priorities of older contenders improve with aging,
+// or if newer contenders go first with LIFO. Its wait file is then marked as held once it acquires the lock.
+func (co *Derailleur) pinsHeld() bool {
+	return co.Priority > 0 || co.AgingInterval > 0 || co.Order == LIFO
+}
+
+// markHeld marks the wait file at filePath as held, which keeps it ahead of all waiting contenders, and returns its new path.
+// If another contender acquired the lock in the meantime, or marks its wait file at the same moment, the mark is removed again,
+// and the wait files that the contender has to wait for are returned along with the original path.
+func (co *Derailleur) markHeld(filePath string) (string, []string, error) {
+	name, ok := parseWaitFileName(co.prefix(), path.Base(filePath))
+	if !ok {
+		return filePath, nil, fmt.Errorf("%s is not a wait file", filePath)
+	}
+	name.held = true
+	heldPath, err := co.moveWaitFile(filePath, name)
+	if err != nil {
+		return filePath, nil, err
+	}
+
+	// Contenders mark their wait files before they look for the marks of others,
+	// so of two contenders that mark theirs at the same moment, at least one notices the other.
+	// The line is checked with the wait file where it was before it was marked, because contenders that don't mark
+	// their wait files, e.g. with a higher priority, may have joined ahead of it in the meantime and found themselves
+	// first. Contenders that join after it was marked queue behind it.
+	line, err := co.waitFiles()
+	if err != nil {
+		return heldPath, nil, err
+	}
+	unmarked := name
+	unmarked.held = false
+	i := -1
+	for j := range line {
+		if line[j].path == heldPath {
+			line[j].name = unmarked
+			i = j
+		}
+	}
+	if i < 0 {
+		return heldPath, nil, ErrLockLost
+	}
+	co.ordering().sort(line)
+	for j := range line {
+		if line[j].path == heldPath {
+			i = j
+		}
+	}
+
+	blockers := co.blockers(line, i)
+	if len(blockers) == 0 {
+		return heldPath, nil, nil
+	}
+
+	name.held = false
+	filePath, err = co.moveWaitFile(heldPath, name)
+	if err != nil {
+		return heldPath, nil, err
+	}
+	return filePath, blockers, nil
+}
+
+// heldPath returns the path that the wait file at filePath has once it is marked as held.
+func (co *Derailleur) heldPath(filePath string) string {
+	name, ok := parseWaitFileName(co.prefix(), path.Base(filePath))
+	if !ok {
+		return filePath
+	}
+	name.held = true
+	return path.Join(path.Dir(filePath), name.format(co.prefix()))
+}
+
+// waitForTurn blocks until one of the wait files in toWatch is removed, one of the wait files ahead expires,
+// or it is time to poll again, after which the line has to be checked again.
+func (co *Derailleur) waitForTurn(ctx context.Context, toWatch []string, ahead []string) error {
+	var removed chan error
+	var polled <-chan time.Time
+
+	if co.PollInterval > 0 {
+		poll := time.NewTimer(co.PollInterval)
+		defer poll.Stop()
+		polled = poll.C
+	} else {
+		removed = make(chan error, 1)
+		stop := co.watchShared(ctx, toWatch, func(_ string, err error) {
+			removed <- err
+		})
+		defer stop()
+	}
+
+	// Wake up when a preceding wait file expires, so that it can be reaped.
+	var expired <-chan time.Time
+	if co.TTL > 0 {
+		var lastModified time.Time
+		for _, filePath := range ahead {
+			info, err := co.fs().Stat(filePath)
+			if err == nil && (lastModified.IsZero() || info.ModTime().Before(lastModified)) {
+				lastModified = info.ModTime()
+			}
+		}
+		if !lastModified.IsZero() {
+			expiry := time.NewTimer(lastModified.Add(co.TTL).Sub(co.clock().Now()))
+			defer expiry.Stop()
+			expired = expiry.C
+		}
+	}
+
+	// Priorities change over time with aging, so the order has to be checked again periodically.
+	var aged <-chan time.Time
+	if co.AgingInterval > 0 {
+		aging := time.NewTimer(co.AgingInterval)
+		defer aging.Stop()
+		aged = aging.C
+	}
+
+	select {
+	case err := <-removed:
+		return err
+	case <-polled:
+	case <-expired:
+	case <-aged:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
 	return nil
 }
+
+// WaitInLineTimeout is like WaitInLine, but gives up and returns ErrTimeout
+// if the lock contender isn't the first in line within the given timeout.
+// On timeout the wait file is removed, so the contender no longer holds a place in line.
+func (co *Derailleur) WaitInLineTimeout(ctx context.Context, timeout time.Duration) error {
+	timeoutCtx, cancelFn := context.WithTimeout(ctx, timeout)
+	defer cancelFn()
+
+	err := co.WaitInLine(timeoutCtx)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return ErrTimeout
+	}
+
+	return err
+}
+
+// WaitInLineCh is like WaitInLine, but waits in the background. The result of waiting is delivered
+// on the returned channel, nil once the lock is acquired or an error otherwise, after which the channel is closed.
+func (co *Derailleur) WaitInLineCh(ctx context.Context) <-chan error {
+	result := make(chan error, 1)
+
+	go func() {
+		defer close(result)
+		result <- co.WaitInLine(ctx)
+	}()
+
+	return result
+}
+
+// Position returns the number of lock contenders that are ahead of this one in line.
+// An Exclusive lock contender holds the lock when its position is less than Limit, e.g. 0 by default,
+// and no Shared contender is ahead of it.
+func (co *Derailleur) Position() (int, error) {
+	return co.position(co.filePath())
+}
+
+// position returns the number of lock contenders that are ahead of the one with the wait file at filePath.
+func (co *Derailleur) position(filePath string) (int, error) {
+	line, err := co.line()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, f := range line {
+		if f == filePath {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s not found in %s", ErrNotInQueue, filePath, co.Dir)
+}
+
+// WaitersBehind returns the number of lock contenders that are behind this one in line,
+// e.g. for a holder to decide whether to scale up. Together with Position it describes the whole line.
+func (co *Derailleur) WaitersBehind() (int, error) {
+	filePath := co.filePath()
+	line, err := co.line()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, f := range line {
+		if f == filePath {
+			return len(line) - i - 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s not found in %s", ErrNotInQueue, filePath, co.Dir)
+}
+
+// WatchPosition returns a channel on which the position of the lock contender in line is sent,
+// first right away and then every time a contender ahead of it leaves the line.
+// The channel is closed once the position reaches 0, the context is cancelled,
+// or the position can't be determined anymore.
+func (co *Derailleur) WatchPosition(ctx context.Context) <-chan int {
+	filePath := co.filePath()
+	// The wait file is renamed once it is marked as held.
+	heldPath := co.heldPath(filePath)
+	positions := make(chan int)
+
+	go func() {
+		defer close(positions)
+
+		lastPosition := -1
+		for {
+			line, err := co.line()
+			if err != nil {
+				return
+			}
+
+			position := -1
+			for i, f := range line {
+				if f == filePath || f == heldPath {
+					position = i
+				}
+			}
+			if position < 0 {
+				return
+			}
+
+			if position != lastPosition {
+				select {
+				case positions <- position:
+				case <-ctx.Done():
+					return
+				}
+				lastPosition = position
+			}
+			if position == 0 {
+				return
+			}
+
+			err = co.waitForTurn(ctx, line[:position], nil)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return positions
+}
+
+// AmIFirst reports whether the lock contender currently holds the lock, without blocking.
+// With a Limit greater than 1, any of the first Limit contenders in line holds the lock,
+// and with Shared contenders, all of them that have no Exclusive contender ahead.
+func (co *Derailleur) AmIFirst() (bool, error) {
+	return co.holds(co.filePath())
+}
+
+// Lock creates a wait file for the lock contender and blocks until it is the first in line.
+// If waiting fails before the lock is acquired, the wait file is removed.
+// Once acquired, a new fencing token is issued, which can be retrieved with Token.
+// A successful Lock should be paired with a call to Release.
+func (co *Derailleur) Lock(ctx context.Context) error {
+	leaveGate, err := co.enterGate(ctx)
+	if err != nil {
+		return err
+	}
+
+	file, err := co.CreateFSWaitFile()
+	if err != nil {
+		leaveGate()
+		return err
+	}
+	file.Close()
+
+	err = co.WaitInLine(ctx)
+	if err == nil {
+		var token uint64
+		token, err = co.nextToken()
+		co.mu.Lock()
+		co.token = token
+		co.mu.Unlock()
+	}
+	if err != nil {
+		_ = co.Abandon()
+		leaveGate()
+		return err
+	}
+
+	co.mu.Lock()
+	co.leaveGate = leaveGate
+	co.mu.Unlock()
+
+	return nil
+}
+
+// TryLock creates a wait file for the lock contender and reports whether it immediately holds the lock.
+// If it isn't, the wait file is removed again, so a failed attempt never leaves the contender in line.
+func (co *Derailleur) TryLock() (bool, error) {
+	file, err := co.CreateFSWaitFile()
+	if err != nil {
+		return false, err
+	}
+	file.Close()
+
+	holds, err := co.holds(co.filePath())
+	if err == nil && holds && co.pinsHeld() {
+		var filePath string
+		var blockers []string
+		filePath, blockers, err = co.markHeld(co.filePath())
+		co.setFilePath(filePath)
+		holds = len(blockers) == 0
+	}
+	if err != nil || !holds {
+		releaseErr := co.Abandon()
+		if err == nil {
+			err = releaseErr
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CutInLine forcibly removes the current lock holder and preceding lock contenders
+// and makes the current contender acquire the lock.
+// Note that this does not affect contenders that succeed the current contender in the line.
+// See ForceAcquire for a way to acquire the lock that keeps the other contenders in line.
+func (co *Derailleur) CutInLine() error {
+	_, err := co.CutInLineContext(context.Background())
+	return err
+}
+
+// CutInLineContext is like CutInLine, but returns the context's error as soon as the context is done,
+// even while a removal is still waiting for a slow filesystem, so that it stays within the time budget of a request.
+// It returns how many of the preceding wait files are gone, including ones that were removed by someone else
+// in the meantime, which is not an error. A removal that was still waiting may complete after it returns.
+func (co *Derailleur) CutInLineContext(ctx context.Context) (int, error) {
+	ahead, err := co.CutInLinePreview()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, filePath := range ahead {
+		err := co.removeWaitFileContext(ctx, filePath)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// CutInLineN is like CutInLine, but removes at most n of the preceding wait files, starting at the front of the line,
+// which moves the contender up by as many positions. It returns how many wait files it removed.
+// Wait files that are removed by someone else in the meantime are not an error, but aren't counted.
+func (co *Derailleur) CutInLineN(n int) (int, error) {
+	ahead, err := co.CutInLinePreview()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, filePath := range ahead {
+		if removed >= n {
+			break
+		}
+		ok, err := co.removeWaitFileIfPresent(filePath)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// CutInLinePreview returns the paths of the wait files that CutInLine would remove, without removing anything,
+// e.g. to log them or ask for confirmation first. Contenders may join or leave the line in the meantime,
+// so CutInLine doesn't necessarily remove the same wait files.
+func (co *Derailleur) CutInLinePreview() ([]string, error) {
+	own := co.filePath()
+	line, err := co.line()
+	if err != nil {
+		return nil, err
+	}
+
+	var ahead []string
+	for _, filePath := range line {
+		if filePath == own {
+			break
+		}
+		ahead = append(ahead, filePath)
+	}
+
+	return ahead, nil
+}
+
+// ForceAcquire makes the current contender acquire the lock by renaming its wait file to one that sorts
+// before any other in the line, with the highest priority and a timestamp and sequence number beyond those of the others.
+// Unlike CutInLine, it doesn't remove anyone: the other contenders keep their wait files, and with them their places
+// behind the contender. Like CutInLine, it doesn't notify the current holder, which may still act as if it held the lock.
+// FilePath is updated to the new path, and WaitInLine returns right away afterwards.
+// It returns ErrNotInQueue if the contender has no wait file.
+func (co *Derailleur) ForceAcquire() error {
+	filePath := co.filePath()
+	if filePath == "" {
+		return ErrNotInQueue
+	}
+
+	line, i, err := co.find(filePath)
+	if err != nil {
+		return err
+	}
+	if i == 0 {
+		return nil
+	}
+
+	name, err := co.frontName(line, i)
+	if err != nil {
+		return err
+	}
+
+	_, err = co.renameWaitFile(filePath, name)
+	return err
+}
+
+// frontName returns a name for the wait file at index i of the line that sorts before all the others.
+func (co *Derailleur) frontName(line []waitFile, i int) (waitFileName, error) {
+	name := line[i].name
+	name.priority = 0
+	name.upgrading = false
+	// Held wait files stay ahead of the others, so the wait file has to be held as well to get ahead of them.
+	for _, f := range line {
+		if f.name.held {
+			name.held = true
+		}
+	}
+
+	// Wait files are taken in the order in which they were created with FIFO, and in the reverse order with LIFO,
+	// so the wait file goes before the earliest one or after the latest one respectively.
+	direction := -1
+	if co.Order == LIFO {
+		direction = 1
+	}
+
+	var timestamp, sequence string
+	for j, f := range line {
+		if j == i {
+			continue
+		}
+		if timestamp == "" || compareNumbers(f.name.timestamp, timestamp) == direction {
+			timestamp = f.name.timestamp
+		}
+		if sequence == "" || compareNumbers(f.name.sequence, sequence) == direction {
+			sequence = f.name.sequence
+		}
+	}
+
+	var err error
+	name.timestamp, err = shiftNumber(timestamp, direction)
+	if err != nil {
+		return waitFileName{}, err
+	}
+	name.sequence, err = shiftNumber(sequence, direction)
+	if err != nil {
+		return waitFileName{}, err
+	}
+
+	ordering := co.ordering()
+	for j, f := range line {
+		if j != i && !ordering.less(name, f.name) {
+			return waitFileName{}, fmt.Errorf("can't sort ahead of %s", f.path)
+		}
+	}
+
+	return name, nil
+}
+
+// shiftNumber increments the decimal number s if direction is positive, and decrements it down to zero otherwise.
+// It keeps the zero padding of s.
+func shiftNumber(s string, direction int) (string, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("can't shift %s: %w", s, err)
+	}
+
+	if direction > 0 {
+		n++
+	} else if n > 0 {
+		n--
+	}
+
+	return fmt.Sprintf("%0*d", len(s), n), nil
+}
+
+// EvictHolder forcibly removes the wait file at filePath, e.g. of a single holder that is known to misbehave,
+// without affecting any other lock contender. It returns an error if filePath isn't a wait file in Dir.
+// A wait file that was already removed is not an error.
+func (co *Derailleur) EvictHolder(filePath string) error {
+	if filepath.Clean(filepath.Dir(filePath)) != filepath.Clean(co.Dir) {
+		return fmt.Errorf("can't evict %s: it isn't in %s", filePath, co.Dir)
+	}
+	if _, ok := parseWaitFileName(co.prefix(), filepath.Base(filePath)); !ok {
+		return fmt.Errorf("can't evict %s: it isn't a wait file", filePath)
+	}
+
+	return co.removeWaitFile(filePath)
+}
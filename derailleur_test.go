@@ -2,9 +2,19 @@ package derailleur
 
 import (
 	"context"
-	log "github.com/sirupsen/logrus"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -18,128 +28,424 @@ func TestWaitForFile(t *testing.T) {
 	watcher := derailleur.WaitForFile(temp.Name(), fileChan)
 	defer watcher.Close()
 
-	deleted := false
+	deleted := make(chan struct{})
 
 	go func() {
 		time.Sleep(2 * time.Second)
+		close(deleted)
 		_ = os.Remove(temp.Name())
-		deleted = true
 	}()
 
 	select {
 	case <-time.After(5 * time.Second):
 		t.Fatal("Didn't react to file being removed.")
 	case <-fileChan:
-		if !deleted {
-			t.Fatal("Watcher activity before deleting.")
+		select {
+		case <-deleted:
+		default:
+			t.Fatal("Reported the file before it was removed.")
 		}
 	}
 }
 
-func TestWaitInLine(t *testing.T) {
+func TestWaitForFileDebounce(t *testing.T) {
+	derailleur := Derailleur{
+		Debounce: 500 * time.Millisecond,
+	}
+
+	temp, _ := os.CreateTemp(os.TempDir(), "test-*")
+
+	fileChan := make(chan error, 1)
+	watcher := derailleur.WaitForFile(temp.Name(), fileChan)
+	defer watcher.Close()
+
+	// Give the watcher time to check that the file still exists.
+	time.Sleep(100 * time.Millisecond)
+	removed := time.Now()
+	_ = os.Remove(temp.Name())
+
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't react to file being removed.")
+	case err := <-fileChan:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(removed) < derailleur.Debounce {
+			t.Fatal("Woke up before the debounce window passed.")
+		}
+	}
+}
+
+func TestWaitForFileAlreadyRemoved(t *testing.T) {
+	derailleur := Derailleur{}
+
+	temp, _ := os.CreateTemp(os.TempDir(), "test-*")
+	temp.Close()
+	_ = os.Remove(temp.Name())
+
+	fileChan := make(chan error)
+	watcher := derailleur.WaitForFile(temp.Name(), fileChan)
+	defer watcher.Close()
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Didn't notice the file being removed before watching.")
+	case err := <-fileChan:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWaitForFileEmptyPath(t *testing.T) {
+	derailleur := Derailleur{}
+
+	fileChan := make(chan error)
+	watcher := derailleur.WaitForFile("", fileChan)
+	defer watcher.Close()
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Didn't reject an empty path.")
+	case err := <-fileChan:
+		if err == nil {
+			t.Fatal("expected an error for an empty path")
+		}
+	}
+}
+
+func TestWaitForFileClosed(t *testing.T) {
+	derailleur := Derailleur{}
+
+	temp, _ := os.CreateTemp(os.TempDir(), "test-*")
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	fileChan := make(chan error)
+	watcher := derailleur.WaitForFile(temp.Name(), fileChan)
+	watcher.Close()
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Didn't react to watcher being closed.")
+	case err := <-fileChan:
+		if !errors.Is(err, ErrWatcherClosed) {
+			t.Fatalf("expected ErrWatcherClosed after closing the watcher, got %v", err)
+		}
+	}
+}
+
+func TestWaitForFileContext(t *testing.T) {
+	derailleur := Derailleur{}
+
+	temp, _ := os.CreateTemp(os.TempDir(), "test-*")
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	fileChan := make(chan error)
+	watcher := derailleur.WaitForFileContext(ctx, temp.Name(), fileChan)
+	defer watcher.Close()
+
+	// Let the watching goroutine start before counting it.
+	time.Sleep(100 * time.Millisecond)
+	goroutines := runtime.NumGoroutine()
+
+	cancelFn()
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Didn't react to the context being cancelled.")
+	case err := <-fileChan:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() >= goroutines {
+		if time.Now().After(deadline) {
+			t.Fatal("watching goroutine didn't exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWaitForAny(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{}
+
+	var filePaths []string
+	for i := 0; i < 3; i++ {
+		f, _ := os.Create(path.Join(dir, fmt.Sprintf("test-%d", i)))
+		f.Close()
+		filePaths = append(filePaths, f.Name())
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = os.Remove(filePaths[1])
+	}()
+
+	removed, err := derailleur.WaitForAny(context.Background(), filePaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != filePaths[1] {
+		t.Fatalf("expected %s to be removed, got %s", filePaths[1], removed)
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFn()
+
+	_, err = derailleur.WaitForAny(ctx, []string{filePaths[0], filePaths[2]})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestWaitForFileFunc(t *testing.T) {
+	derailleur := Derailleur{}
+
+	temp, _ := os.CreateTemp(os.TempDir(), "test-*")
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	var names []string
+	written := func(event fsnotify.Event) bool {
+		names = append(names, event.Name)
+		return event.Op&fsnotify.Write != 0
+	}
+
+	fileChan := make(chan error)
+	watcher := derailleur.WaitForFileFunc(context.Background(), temp.Name(), written, fileChan)
+	defer watcher.Close()
+
+	select {
+	case <-fileChan:
+		t.Fatal("Reported an event before the file was written.")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err := os.WriteFile(temp.Name(), []byte("written"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write not reported.")
+	case err := <-fileChan:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range names {
+		if name != temp.Name() {
+			t.Fatalf("expected events to be named %s, got %s", temp.Name(), name)
+		}
+	}
+}
+
+func TestWaitForAll(t *testing.T) {
 	dir, err := os.MkdirTemp("", "juju-task-testing-*")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.Remove(dir)
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{}
+
+	var filePaths []string
+	for i := 0; i < 3; i++ {
+		f, _ := os.Create(path.Join(dir, fmt.Sprintf("test-%d", i)))
+		f.Close()
+		filePaths = append(filePaths, f.Name())
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelFn()
+
+	_ = os.Remove(filePaths[0])
+	err = derailleur.WaitForAll(ctx, filePaths)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded while files remain, got %v", err)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- derailleur.WaitForAll(context.Background(), filePaths)
+	}()
+
+	for _, filePath := range filePaths[1:] {
+		select {
+		case <-done:
+			t.Fatal("Returned while files remain.")
+		case <-time.After(100 * time.Millisecond):
+		}
+		_ = os.Remove(filePath)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Didn't return after all files were removed.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWaitForFileNoLeak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creating many watchers is slow")
+	}
+
+	derailleur := Derailleur{}
+
+	temp, _ := os.CreateTemp(os.TempDir(), "test-*")
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 1000; i++ {
+		fileChan := make(chan error, 1)
+		watcher := derailleur.WaitForFile(temp.Name(), fileChan)
+		watcher.Close()
+	}
+
+	// Give the watching goroutines a moment to observe the closed watchers.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before+10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d before, %d after", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWaitInLine(t *testing.T) {
+	memFS := newMemFS()
 
 	derailleur := Derailleur{
-		Dir: dir,
+		Dir:          "/queue",
+		FS:           memFS,
+		PollInterval: 10 * time.Millisecond,
 	}
 
-	file, err := derailleur.CreateWaitFile()
+	file, err := derailleur.CreateFSWaitFile()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.Remove(file.Name())
+	file.Close()
 
-	first, _ := os.Create(path.Join(dir, "0"))
-	defer os.Remove(first.Name())
+	first := path.Join("/queue", "queuer-W-0-0-0-0")
+	err = memFS.WriteFile(first, nil, defaultFilePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	done := make(chan struct{})
+	done := make(chan error)
 
 	go func() {
-		derailleur.WaitInLine(context.Background())
-		done <- struct{}{}
+		done <- derailleur.WaitInLine(context.Background())
 	}()
 
-	deleted := false
+	deleted := make(chan struct{})
 
 	go func() {
-		time.Sleep(2 * time.Second)
-		_ = os.Remove(first.Name())
-		deleted = true
+		time.Sleep(200 * time.Millisecond)
+		close(deleted)
+		_ = memFS.Remove(first)
 	}()
 
 	select {
-	case <-time.After(5 * time.Second):
+	case <-time.After(2 * time.Second):
 		t.Fatal("Didn't react to file being removed.")
-	case <-done:
-		if !deleted {
-			t.Fatal("Watcher activity before deleting.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-deleted:
+		default:
+			t.Fatal("Acquired before the preceding file was removed.")
 		}
 	}
 }
 
 func TestWaitInLineMultiple(t *testing.T) {
-	dir, err := os.MkdirTemp("", "juju-task-testing-*")
-	if err != nil {
-		t.Fatal(err)
-	}
+	memFS := newMemFS()
 
 	n := 5
 	done := make(chan string)
 
 	for i := 0; i < n; i++ {
 		derailleur := Derailleur{
-			Dir: dir,
+			Dir:          "/queue",
+			FS:           memFS,
+			PollInterval: 10 * time.Millisecond,
 		}
-		file, err := derailleur.CreateWaitFile()
+		file, err := derailleur.CreateFSWaitFile()
 		if err != nil {
 			t.Fatal(err)
 		}
-		//goland:noinspection GoDeferInLoop
-		defer os.Remove(file.Name())
+		file.Close()
 
 		go func() {
-			derailleur.WaitInLine(context.Background())
+			err := derailleur.WaitInLine(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
 			done <- derailleur.FilePath
 		}()
 	}
 
-	files, _ := os.ReadDir(dir)
+	files, _ := memFS.ReadDir("/queue")
 
 	// First contender should wake up immediately
 	select {
 	case <-time.After(2 * time.Second):
 		t.Fatal("Queuer not waking up.")
 	case c := <-done:
-		if c != path.Join(dir, files[0].Name()) {
+		if c != path.Join("/queue", files[0].Name()) {
 			t.Fatal("Wrong wait order.")
 		}
 	}
 
 	for i := 1; i < n; i++ {
-		queuer := path.Join(dir, files[i].Name())
-		deleted := false
+		queuer := path.Join("/queue", files[i].Name())
+		deleted := make(chan struct{})
 
 		go func(i int) {
-			time.Sleep(2 * time.Second)
-			toRemove := path.Join(dir, files[i-1].Name())
-			log.Printf("removing %s", toRemove)
-			log.Printf("expecting to wake up %s", queuer)
-			err = os.Remove(toRemove)
+			time.Sleep(200 * time.Millisecond)
+			toRemove := path.Join("/queue", files[i-1].Name())
+			t.Logf("removing %s", toRemove)
+			t.Logf("expecting to wake up %s", queuer)
+			close(deleted)
+			err := memFS.Remove(toRemove)
 			if err != nil {
-				log.Error(err)
+				t.Error(err)
 			}
-			deleted = true
 		}(i)
 
 		select {
-		case <-time.After(5 * time.Second):
+		case <-time.After(2 * time.Second):
 			t.Fatal("Queuer not waking up.")
 		case c := <-done:
-			if !deleted {
+			select {
+			case <-deleted:
+			default:
 				t.Fatal("Cut in line.")
 			}
 			if c != queuer {
@@ -150,39 +456,48 @@ func TestWaitInLineMultiple(t *testing.T) {
 }
 
 func TestWaitInLineCancel(t *testing.T) {
-	dir, err := os.MkdirTemp("", "juju-task-testing-*")
-	if err != nil {
-		t.Fatal(err)
-	}
+	memFS := newMemFS()
 
 	derailleur := Derailleur{
-		Dir: dir,
+		Dir:          "/queue",
+		FS:           memFS,
+		PollInterval: 10 * time.Millisecond,
 	}
 
-	file, err := derailleur.CreateWaitFile()
+	file, err := derailleur.CreateFSWaitFile()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.Remove(file.Name())
+	file.Close()
 
-	first, _ := os.Create(path.Join(dir, "0"))
-	defer os.Remove(first.Name())
+	err = memFS.WriteFile(path.Join("/queue", "queuer-W-0-0-0-0"), nil, defaultFilePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	done := make(chan struct{})
+	done := make(chan error)
 
 	ctx, cancelFn := context.WithCancel(context.Background())
 
 	go func() {
-		derailleur.WaitInLine(ctx)
-		done <- struct{}{}
+		done <- derailleur.WaitInLine(ctx)
 	}()
 
+	// Give WaitInLine time to start polling the line.
+	time.Sleep(100 * time.Millisecond)
 	cancelFn()
 
 	select {
 	case <-time.After(1 * time.Second):
 		t.Fatal("WaitInLine not cancelling")
-	case <-done:
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	}
+
+	if _, err := memFS.Stat(file.Name()); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("wait file not removed after cancellation")
 	}
 }
 
@@ -225,3 +540,2411 @@ func TestCutInLine(t *testing.T) {
 		t.Fatal("too many wait files found")
 	}
 }
+
+func TestCutInLinePreview(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ahead []string
+	for i := 0; i < 3; i++ {
+		derailleur := Derailleur{
+			Dir: dir,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		ahead = append(ahead, file.Name())
+	}
+
+	cutter := Derailleur{
+		Dir: dir,
+	}
+	file, err := cutter.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	preview, err := cutter.CutInLinePreview()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(preview) != len(ahead) {
+		t.Fatalf("expected %d wait files, got %d", len(ahead), len(preview))
+	}
+	for i := range preview {
+		if preview[i] != ahead[i] {
+			t.Fatalf("expected %s at position %d, got %s", ahead[i], i, preview[i])
+		}
+	}
+
+	// Nothing is removed.
+	files, _ := os.ReadDir(dir)
+	if len(files) != len(ahead)+1 {
+		t.Fatal("wait files removed by preview")
+	}
+}
+
+func TestForceAcquire(t *testing.T) {
+	for _, order := range []Order{FIFO, LIFO} {
+		dir, err := os.MkdirTemp("", "juju-task-testing-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		//goland:noinspection GoDeferInLoop
+		defer os.RemoveAll(dir)
+
+		var others []string
+		for priority := 0; priority < 3; priority++ {
+			derailleur := Derailleur{
+				Dir:      dir,
+				Order:    order,
+				Priority: priority,
+			}
+			file, err := derailleur.CreateWaitFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+			others = append(others, file.Name())
+		}
+
+		forcer := Derailleur{
+			Dir:      dir,
+			Order:    order,
+			Priority: 5,
+		}
+
+		err = forcer.ForceAcquire()
+		if !errors.Is(err, ErrNotInQueue) {
+			t.Fatalf("expected ErrNotInQueue without a wait file, got %v", err)
+		}
+
+		file, err := forcer.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		err = forcer.ForceAcquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		line, err := forcer.line()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(line) != len(others)+1 || line[0] != forcer.FilePath {
+			t.Fatalf("expected the forcer to be first in line with everyone else behind it, got %v", line)
+		}
+		for _, filePath := range others {
+			if _, err := os.Stat(filePath); err != nil {
+				t.Fatalf("wait file %s of another contender is gone", filePath)
+			}
+		}
+
+		err = forcer.WaitInLine(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCutInLineN(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ahead []string
+	for i := 0; i < 3; i++ {
+		derailleur := Derailleur{
+			Dir: dir,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		ahead = append(ahead, file.Name())
+	}
+
+	cutter := Derailleur{
+		Dir: dir,
+	}
+	file, err := cutter.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	removed, err := cutter.CutInLineN(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 removed wait files, got %d", removed)
+	}
+
+	for i, filePath := range ahead {
+		_, err := os.Stat(filePath)
+		if i < 2 && !os.IsNotExist(err) {
+			t.Fatalf("wait file at position %d not removed", i)
+		}
+		if i >= 2 && err != nil {
+			t.Fatalf("wait file at position %d removed", i)
+		}
+	}
+
+	removed, err = cutter.CutInLineN(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("expected 1 removed wait file, got %d", removed)
+	}
+
+	first, err := cutter.AmIFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first {
+		t.Fatal("not first after cutting in line")
+	}
+}
+
+// releasingFS is an FS that records which files are renamed and fails removals with ESTALE a number of times,
+// to check that wait files are removed with RenameOnRelease and Retry applied.
+type releasingFS struct {
+	FS
+	mu       sync.Mutex
+	renamed  []string
+	failures int
+}
+
+func (f *releasingFS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	f.renamed = append(f.renamed, oldpath)
+	f.mu.Unlock()
+
+	return f.FS.Rename(oldpath, newpath)
+}
+
+func (f *releasingFS) Remove(name string) error {
+	f.mu.Lock()
+	if f.failures > 0 {
+		f.failures--
+		f.mu.Unlock()
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ESTALE}
+	}
+	f.mu.Unlock()
+
+	return f.FS.Remove(name)
+}
+
+// checkReleased fails the test unless exactly the wait files at released were renamed before they were removed,
+// and no renamed wait file was left behind in dir.
+func checkReleased(t *testing.T, releasing *releasingFS, dir string, released []string) {
+	t.Helper()
+
+	if strings.Join(releasing.renamed, ",") != strings.Join(released, ",") {
+		t.Fatalf("expected %v to be renamed before removal, got %v", released, releasing.renamed)
+	}
+	for _, filePath := range released {
+		_, err := os.Stat(filePath)
+		if !os.IsNotExist(err) {
+			t.Fatalf("wait file %s not removed", filePath)
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), releasingSuffix) {
+			t.Fatalf("renamed wait file %s left behind", f.Name())
+		}
+	}
+}
+
+func TestCutInLineNRelease(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ahead []string
+	for i := 0; i < 3; i++ {
+		derailleur := Derailleur{
+			Dir: dir,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		ahead = append(ahead, file.Name())
+	}
+
+	releasing := &releasingFS{FS: osFS{}, failures: 1}
+	cutter := Derailleur{
+		Dir:             dir,
+		FS:              releasing,
+		RenameOnRelease: true,
+		Retry: RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     time.Millisecond,
+		},
+	}
+	file, err := cutter.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	removed, err := cutter.CutInLineN(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 removed wait files, got %d", removed)
+	}
+	checkReleased(t, releasing, dir, ahead[:2])
+}
+
+func TestMaxQueueDepth(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contenders := make([]*Derailleur, 3)
+	for i := range contenders {
+		contenders[i] = &Derailleur{
+			Dir:           dir,
+			MaxQueueDepth: 2,
+		}
+	}
+
+	for _, derailleur := range contenders[:2] {
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	_, err = contenders[2].CreateWaitFile()
+	if err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("expected no wait file to be created, got %d files", len(files))
+	}
+
+	_ = contenders[0].Release()
+
+	file, err := contenders[2].CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+}
+
+func TestRenameOnRelease(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir:             dir,
+		RenameOnRelease: true,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	done := make(chan error)
+
+	go func() {
+		done <- derailleur.WaitInLine(context.Background())
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	released := holder.FilePath
+	err = holder.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Lock not acquired after release.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), releasingSuffix) {
+			t.Fatalf("renamed wait file %s not removed", f.Name())
+		}
+	}
+	if _, err := os.Stat(released); !os.IsNotExist(err) {
+		t.Fatal("released wait file not removed")
+	}
+}
+
+func TestReset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// The wait file is lost, e.g. removed by another process.
+	_ = os.Remove(file.Name())
+	err = derailleur.WaitInLine(context.Background())
+	if err != ErrLockLost {
+		t.Fatalf("expected ErrLockLost, got %v", err)
+	}
+
+	derailleur.Reset()
+	if derailleur.FilePath != "" {
+		t.Fatalf("expected FilePath to be cleared, got %s", derailleur.FilePath)
+	}
+
+	err = derailleur.WaitInLine(context.Background())
+	if !errors.Is(err, ErrNotInQueue) {
+		t.Fatalf("expected ErrNotInQueue after reset, got %v", err)
+	}
+
+	// The same Derailleur can acquire the lock again.
+	for i := 0; i < 2; i++ {
+		err = derailleur.Lock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = derailleur.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	err = derailleur.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derailleur.FilePath != "" {
+		t.Fatal("FilePath not cleared after release")
+	}
+	if _, err := os.Stat(file.Name()); !os.IsNotExist(err) {
+		t.Fatal("wait file still exists after release")
+	}
+
+	// Releasing an already removed wait file is not an error.
+	derailleur.FilePath = file.Name()
+	err = derailleur.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := &recordingLogger{}
+	metrics := &recordingMetrics{}
+	derailleur := Derailleur{
+		Dir:     dir,
+		Logger:  logger,
+		Metrics: metrics,
+	}
+
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	err = derailleur.Abandon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derailleur.FilePath != "" {
+		t.Fatal("FilePath not cleared after abandoning")
+	}
+	if _, err := os.Stat(file.Name()); !os.IsNotExist(err) {
+		t.Fatal("wait file still exists after abandoning")
+	}
+
+	if len(logger.messages) != 1 || logger.messages[0] != "Left the line without acquiring the lock." {
+		t.Fatalf("unexpected log messages %q", logger.messages)
+	}
+	if metrics.released != 0 {
+		t.Fatal("abandoning counted as a release")
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	err = derailleur.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(derailleur.FilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	err = derailleur.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockCancel(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, _ := os.Create(path.Join(dir, "queuer-W-0-0-0-0"))
+	first.Close()
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancelFn()
+
+	err = derailleur.Lock(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatal("wait file not cleaned up after cancellation")
+	}
+}
+
+func TestWaitersBehind(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unrelated, _ := os.Create(path.Join(dir, "unrelated"))
+	unrelated.Close()
+
+	n := 3
+	derailleurs := make([]*Derailleur, n)
+	for i := 0; i < n; i++ {
+		derailleurs[i] = &Derailleur{
+			Dir: dir,
+		}
+		file, err := derailleurs[i].CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	for i, derailleur := range derailleurs {
+		behind, err := derailleur.WaitersBehind()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if behind != n-i-1 {
+			t.Fatalf("expected %d waiters behind contender %d, got %d", n-i-1, i, behind)
+		}
+	}
+
+	_ = derailleurs[0].Release()
+	_, err = derailleurs[0].WaitersBehind()
+	if !errors.Is(err, ErrNotInQueue) {
+		t.Fatalf("expected ErrNotInQueue for a released contender, got %v", err)
+	}
+}
+
+func TestPosition(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 3
+	derailleurs := make([]*Derailleur, n)
+	for i := 0; i < n; i++ {
+		derailleurs[i] = &Derailleur{
+			Dir: dir,
+		}
+		file, err := derailleurs[i].CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	for i, derailleur := range derailleurs {
+		position, err := derailleur.Position()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if position != i {
+			t.Fatalf("expected position %d, got %d", i, position)
+		}
+	}
+
+	err = derailleurs[0].Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = derailleurs[0].Position()
+	if !errors.Is(err, ErrNotInQueue) {
+		t.Fatalf("expected ErrNotInQueue for a released contender, got %v", err)
+	}
+
+	err = derailleurs[0].WaitInLine(context.Background())
+	if !errors.Is(err, ErrNotInQueue) {
+		t.Fatalf("expected ErrNotInQueue for a released contender, got %v", err)
+	}
+
+	position, err := derailleurs[2].Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 1 {
+		t.Fatalf("expected position 1, got %d", position)
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	acquired, err := holder.TryLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acquired {
+		t.Fatal("expected to acquire an uncontended lock")
+	}
+
+	contender := Derailleur{
+		Dir: dir,
+	}
+	acquired, err = contender.TryLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acquired {
+		t.Fatal("acquired a lock that is already held")
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatal("failed attempt left a wait file behind")
+	}
+}
+
+func TestWaitInLineTimeout(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, _ := os.Create(path.Join(dir, "queuer-W-0-0-0-0"))
+	first.Close()
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	err = derailleur.WaitInLineTimeout(context.Background(), 500*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+
+	if _, err := os.Stat(file.Name()); !os.IsNotExist(err) {
+		t.Fatal("wait file not removed after timeout")
+	}
+}
+
+func TestWaitInLineCh(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, _ := os.Create(path.Join(dir, "queuer-W-0-0-0-0"))
+	first.Close()
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	result := derailleur.WaitInLineCh(context.Background())
+
+	select {
+	case <-result:
+		t.Fatal("Acquired the lock before it was released.")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	_ = os.Remove(first.Name())
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Lock not acquired after release.")
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := <-result; ok {
+		t.Fatal("result channel not closed")
+	}
+}
+
+func TestLineIgnoresUnrelatedFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{".DS_Store", "a.swp"} {
+		f, _ := os.Create(path.Join(dir, name))
+		f.Close()
+	}
+	err = os.Mkdir(path.Join(dir, "lock"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := Derailleur{
+		Dir: dir,
+	}
+	file, err := first.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	second := Derailleur{
+		Dir: dir,
+	}
+	file, err = second.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	position, err := second.Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 1 {
+		t.Fatalf("expected position 1, got %d", position)
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), time.Second)
+	defer cancelFn()
+
+	err = first.WaitInLine(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = second.CutInLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 4 {
+		t.Fatal("CutInLine removed unrelated files")
+	}
+}
+
+func TestCreateWaitFilePermissions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir:      path.Join(dir, "queue"),
+		DirPerm:  0700,
+		FilePerm: 0600,
+	}
+
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	info, err := os.Stat(derailleur.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Fatalf("expected dir permissions 0700, got %o", info.Mode().Perm())
+	}
+
+	info, err = os.Stat(derailleur.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected file permissions 0600, got %o", info.Mode().Perm())
+	}
+
+	defaults := Derailleur{
+		Dir: derailleur.Dir,
+	}
+	file, err = defaults.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	info, err = os.Stat(defaults.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Fatalf("expected file permissions 0644, got %o", info.Mode().Perm())
+	}
+}
+
+func TestCreateWaitFileContext(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hung := &hungFS{FS: osFS{}, unblock: make(chan struct{})}
+	derailleur := Derailleur{
+		Dir: dir,
+		FS:  hung,
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFn()
+
+	_, err = derailleur.CreateWaitFileContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if derailleur.FilePath != "" {
+		t.Fatal("expected no FilePath to be set")
+	}
+
+	// The wait file created once the filesystem recovers is cleaned up.
+	close(hung.unblock)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		files, _ := os.ReadDir(dir)
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("wait file not cleaned up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	file, err := derailleur.CreateWaitFileContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if derailleur.FilePath != file.Name() {
+		t.Fatalf("expected FilePath %s, got %s", file.Name(), derailleur.FilePath)
+	}
+}
+
+// hungFS is an FS on which creating directories blocks until unblock is closed.
+type hungFS struct {
+	FS
+	unblock chan struct{}
+}
+
+func (f *hungFS) MkdirAll(path string, perm os.FileMode) error {
+	<-f.unblock
+	return f.FS.MkdirAll(path, perm)
+}
+
+func TestWaitInLineLimit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 5
+	limit := 3
+	derailleurs := make([]*Derailleur, n)
+	acquired := make(chan int)
+
+	for i := 0; i < n; i++ {
+		derailleurs[i] = &Derailleur{
+			Dir:   dir,
+			Limit: limit,
+		}
+		file, err := derailleurs[i].CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	for i, derailleur := range derailleurs {
+		go func(i int, derailleur *Derailleur) {
+			err := derailleur.WaitInLine(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			acquired <- i
+		}(i, derailleur)
+	}
+
+	holding := map[int]bool{}
+	for len(holding) < limit {
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("Holders not waking up.")
+		case i := <-acquired:
+			holding[i] = true
+		}
+	}
+
+	select {
+	case i := <-acquired:
+		t.Fatalf("contender %d acquired while %d contenders hold the lock", i, limit)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	for i := limit; i < n; i++ {
+		err := derailleurs[i-limit].Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("Contender not waking up.")
+		case c := <-acquired:
+			if c != i {
+				t.Fatalf("expected contender %d to acquire, got %d", i, c)
+			}
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur, err := New(path.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(derailleur.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Fatal("Dir is not a directory")
+	}
+
+	_, err = New("")
+	if err == nil {
+		t.Fatal("expected an error for an empty directory")
+	}
+}
+
+func TestDisableAutoCreateDir(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir:                  path.Join(dir, "queue"),
+		DisableAutoCreateDir: true,
+	}
+
+	_, err = derailleur.CreateWaitFile()
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected an error for a missing directory, got %v", err)
+	}
+	if _, err := os.Stat(derailleur.Dir); !os.IsNotExist(err) {
+		t.Fatal("directory was created")
+	}
+
+	derailleur.Dir = dir
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+}
+
+func TestCutInLineContext(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 3; i++ {
+		derailleur := Derailleur{
+			Dir: dir,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	cutter := Derailleur{
+		Dir: dir,
+	}
+	file, err := cutter.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	cancelFn()
+
+	removed, err := cutter.CutInLineContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if removed != 0 {
+		t.Fatalf("expected no removed wait files, got %d", removed)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 4 {
+		t.Fatal("removed wait files after cancellation")
+	}
+
+	// Simulate another process removing a wait file first.
+	cutter.FS = &removedFS{FS: osFS{}, removed: path.Join(dir, files[1].Name())}
+
+	removed, err = cutter.CutInLineContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Fatalf("expected 3 removed wait files, got %d", removed)
+	}
+
+	files, _ = os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatal("too many wait files found")
+	}
+}
+
+// slowRemoveFS is an FS whose removals take delay, like a slow network mount.
+type slowRemoveFS struct {
+	FS
+	delay time.Duration
+}
+
+func (f *slowRemoveFS) Remove(name string) error {
+	time.Sleep(f.delay)
+	return f.FS.Remove(name)
+}
+
+func TestCutInLineContextDeadline(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 5; i++ {
+		derailleur := Derailleur{
+			Dir: dir,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	cutter := Derailleur{
+		Dir: dir,
+		FS:  &slowRemoveFS{FS: osFS{}, delay: 200 * time.Millisecond},
+	}
+	file, err := cutter.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelFn()
+
+	start := time.Now()
+	removed, err := cutter.CutInLineContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 450*time.Millisecond {
+		t.Fatalf("returned %s after the deadline", elapsed-300*time.Millisecond)
+	}
+	if removed != 1 {
+		t.Fatalf("expected 1 removed wait file, got %d", removed)
+	}
+}
+
+func TestEvictHolder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	var filePaths []string
+	for i := 0; i < 3; i++ {
+		file, err := derailleur.createWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		filePaths = append(filePaths, file.Name())
+	}
+
+	err = derailleur.EvictHolder(filePaths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := derailleur.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(line) != 2 || line[0] != filePaths[0] || line[1] != filePaths[2] {
+		t.Fatalf("expected only %s to be evicted, got %v", filePaths[1], line)
+	}
+
+	unrelated, _ := os.Create(path.Join(dir, "unrelated"))
+	unrelated.Close()
+
+	for _, filePath := range []string{unrelated.Name(), path.Join(os.TempDir(), path.Base(filePaths[0]))} {
+		err = derailleur.EvictHolder(filePath)
+		if err == nil {
+			t.Fatalf("expected an error evicting %s", filePath)
+		}
+	}
+	if _, err := os.Stat(unrelated.Name()); err != nil {
+		t.Fatal("unrelated file was removed")
+	}
+}
+
+// removedFS is an FS that removes a file behind the back of its user right before listing a directory.
+type removedFS struct {
+	FS
+	removed string
+}
+
+func (f *removedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	files, err := f.FS.ReadDir(name)
+	_ = os.Remove(f.removed)
+	return files, err
+}
+
+func TestAmIFirst(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := Derailleur{
+		Dir: dir,
+	}
+	file, err := first.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	second := Derailleur{
+		Dir: dir,
+	}
+	file, err = second.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	isFirst, err := first.AmIFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFirst {
+		t.Fatal("first contender doesn't hold the lock")
+	}
+
+	isFirst, err = second.AmIFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isFirst {
+		t.Fatal("second contender holds the lock")
+	}
+
+	err = first.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isFirst, err = second.AmIFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFirst {
+		t.Fatal("second contender doesn't hold the lock after the first released it")
+	}
+}
+
+func TestWatchPosition(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 3
+	derailleurs := make([]*Derailleur, n)
+	for i := 0; i < n; i++ {
+		derailleurs[i] = &Derailleur{
+			Dir: dir,
+		}
+		file, err := derailleurs[i].CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	positions := derailleurs[n-1].WatchPosition(context.Background())
+
+	for expected := n - 1; expected >= 0; expected-- {
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("Position not reported.")
+		case position := <-positions:
+			if position != expected {
+				t.Fatalf("expected position %d, got %d", expected, position)
+			}
+		}
+
+		if expected > 0 {
+			err := derailleurs[n-1-expected].Release()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Channel not closed after reaching the front of the line.")
+	case _, ok := <-positions:
+		if ok {
+			t.Fatal("unexpected position after reaching the front of the line")
+		}
+	}
+}
+
+func TestWaitInLineLockLost(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, _ := os.Create(path.Join(dir, "queuer-W-0-0-0-0"))
+	first.Close()
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	done := make(chan error)
+
+	go func() {
+		done <- derailleur.WaitInLine(context.Background())
+	}()
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = os.Remove(file.Name())
+	}()
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Didn't react to the own wait file being removed.")
+	case err := <-done:
+		if err != ErrLockLost {
+			t.Fatalf("expected ErrLockLost, got %v", err)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	for _, order := range []Order{FIFO, LIFO} {
+		dir, err := os.MkdirTemp("", "juju-task-testing-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		n := 3
+		derailleurs := make([]*Derailleur, n)
+		for i := 0; i < n; i++ {
+			derailleurs[i] = &Derailleur{
+				Dir:   dir,
+				Order: order,
+			}
+			file, err := derailleurs[i].CreateWaitFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+		}
+
+		holder, waiters := derailleurs[0], derailleurs[1:]
+		if order == LIFO {
+			holder, waiters = derailleurs[n-1], derailleurs[:n-1]
+		}
+
+		ctx, cancelFn := context.WithTimeout(context.Background(), 2*time.Second)
+		err = holder.WaitInLine(ctx)
+		cancelFn()
+		if err != nil {
+			t.Fatalf("order %d: wrong holder: %v", order, err)
+		}
+
+		// A contender that joins while the lock is held must wait for it as well.
+		newcomer := &Derailleur{
+			Dir:   dir,
+			Order: order,
+		}
+		file, err := newcomer.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		waiters = append(waiters, newcomer)
+
+		isFirst, err := holder.AmIFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isFirst {
+			t.Fatalf("order %d: holder overtaken by a contender that joined later", order)
+		}
+
+		acquired := make(chan *Derailleur)
+		for _, waiter := range waiters {
+			go func(waiter *Derailleur) {
+				err := waiter.WaitInLine(context.Background())
+				if err != nil {
+					t.Error(err)
+				}
+				acquired <- waiter
+			}(waiter)
+		}
+
+		select {
+		case <-acquired:
+			t.Fatalf("order %d: acquired a lock that is already held", order)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		err = holder.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// FIFO hands the lock on from the oldest waiter to the newest, and LIFO the other way around.
+		expected := waiters
+		if order == LIFO {
+			expected = []*Derailleur{waiters[2], waiters[1], waiters[0]}
+		}
+		for i, waiter := range expected {
+			select {
+			case <-time.After(2 * time.Second):
+				t.Fatalf("order %d: contender not waking up", order)
+			case next := <-acquired:
+				if next != waiter {
+					t.Fatalf("order %d: wrong contender acquired the lock at position %d", order, i)
+				}
+				err = next.Release()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestSharedMode(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modes := []Mode{Shared, Shared, Exclusive, Shared}
+	derailleurs := make([]*Derailleur, len(modes))
+	acquired := make(chan int)
+
+	for i, mode := range modes {
+		derailleurs[i] = &Derailleur{
+			Dir:  dir,
+			Mode: mode,
+		}
+		file, err := derailleurs[i].CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	for i, derailleur := range derailleurs {
+		go func(i int, derailleur *Derailleur) {
+			err := derailleur.WaitInLine(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			acquired <- i
+		}(i, derailleur)
+	}
+
+	expectAcquired := func(expected ...int) {
+		t.Helper()
+
+		holding := map[int]bool{}
+		for len(holding) < len(expected) {
+			select {
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Holders not waking up, expected %v to acquire.", expected)
+			case i := <-acquired:
+				holding[i] = true
+			}
+		}
+		for _, i := range expected {
+			if !holding[i] {
+				t.Fatalf("expected contender %d to acquire, got %v", i, holding)
+			}
+		}
+
+		select {
+		case i := <-acquired:
+			t.Fatalf("contender %d acquired unexpectedly", i)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+
+	// Both readers at the front hold the lock together.
+	expectAcquired(0, 1)
+
+	err = derailleurs[0].Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The writer waits for the remaining reader.
+	expectAcquired()
+
+	err = derailleurs[1].Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reader behind the writer waits until it is done.
+	expectAcquired(2)
+
+	err = derailleurs[2].Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAcquired(3)
+}
+
+// countingFS is an FS that counts how often directories are listed.
+type countingFS struct {
+	FS
+	readDirs int64
+	stats    int64
+}
+
+func (f *countingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	atomic.AddInt64(&f.readDirs, 1)
+	return f.FS.ReadDir(name)
+}
+
+func (f *countingFS) Stat(name string) (fs.FileInfo, error) {
+	atomic.AddInt64(&f.stats, 1)
+	return f.FS.Stat(name)
+}
+
+func TestWaitInLineUncontended(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	counting := &countingFS{FS: osFS{}}
+	derailleur := Derailleur{
+		Dir: dir,
+		FS:  counting,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	atomic.StoreInt64(&counting.readDirs, 0)
+	atomic.StoreInt64(&counting.stats, 0)
+
+	err = derailleur.WaitInLine(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readDirs, stats := atomic.LoadInt64(&counting.readDirs), atomic.LoadInt64(&counting.stats); readDirs != 1 || stats != 0 {
+		t.Fatalf("expected a single listing for an uncontended acquisition, got %d listings and %d stats", readDirs, stats)
+	}
+}
+
+func BenchmarkWaitInLineBurst(b *testing.B) {
+	for _, debounce := range []time.Duration{-1, defaultDebounce} {
+		name := "Debounce=" + debounce.String()
+		if debounce < 0 {
+			name = "Debounce=off"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "juju-task-testing-*")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			counting := &countingFS{FS: osFS{}}
+			n := 100
+			var readDirs int64
+
+			for i := 0; i < b.N; i++ {
+				ahead := make([]string, n)
+				for j := range ahead {
+					ahead[j] = path.Join(dir, fmt.Sprintf("queuer-W-0-%d-0-0", j+1))
+					f, _ := os.Create(ahead[j])
+					f.Close()
+				}
+
+				derailleur := Derailleur{
+					Dir:      dir,
+					FS:       counting,
+					Debounce: debounce,
+				}
+				file, err := derailleur.CreateWaitFile()
+				if err != nil {
+					b.Fatal(err)
+				}
+				file.Close()
+
+				acquired := make(chan error)
+				go func() {
+					acquired <- derailleur.WaitInLine(context.Background())
+				}()
+
+				// Wait for the contender to start watching before removing the contenders ahead of it in a burst,
+				// from the back of the line to the front, so that every removal affects the watched wait file.
+				for atomic.LoadInt64(&counting.readDirs) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				time.Sleep(50 * time.Millisecond)
+				for j := n - 1; j >= 0; j-- {
+					_ = os.Remove(ahead[j])
+					time.Sleep(100 * time.Microsecond)
+				}
+
+				err = <-acquired
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = derailleur.Release()
+				readDirs += atomic.SwapInt64(&counting.readDirs, 0)
+			}
+
+			b.ReportMetric(float64(readDirs)/float64(b.N), "readdirs/op")
+		})
+	}
+}
+
+func BenchmarkWatchBusyDir(b *testing.B) {
+	for _, watchFiles := range []bool{false, true} {
+		b.Run(fmt.Sprintf("WatchFiles=%t", watchFiles), func(b *testing.B) {
+			dir := benchmarkDir(b)
+			defer os.RemoveAll(dir)
+
+			watchedPath := path.Join(dir, "queuer-W-0-0-0-0")
+			f, _ := os.Create(watchedPath)
+			f.Close()
+
+			watched, targets, err := watchTargets([]string{watchedPath}, watchFiles)
+			if err != nil {
+				b.Fatal(err)
+			}
+			watcher, err := newWatcher(targets, defaultWatcherSetupTimeout)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer watcher.Close()
+
+			// Count the events the watcher delivers until the watched file is removed.
+			counted := make(chan int)
+			go func() {
+				events := 0
+				for {
+					select {
+					case event := <-watcher.Events:
+						events++
+						if _, ok := watched[filepath.Clean(event.Name)]; ok && isRemoval(event) {
+							counted <- events
+							return
+						}
+					case <-watcher.Errors:
+					}
+				}
+			}()
+
+			// Other contenders join and leave the line in the same directory.
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				other := path.Join(dir, fmt.Sprintf("queuer-W-0-%d-0-0", i+1))
+				f, _ := os.Create(other)
+				f.Close()
+				_ = os.Remove(other)
+			}
+			_ = os.Remove(watchedPath)
+
+			b.ReportMetric(float64(<-counted)/float64(b.N), "events/op")
+		})
+	}
+}
+
+// benchmarkDir creates a temporary directory for a benchmark, on tmpfs where available to reduce disk noise.
+func benchmarkDir(b *testing.B) string {
+	parent := ""
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		parent = "/dev/shm"
+	}
+
+	dir, err := os.MkdirTemp(parent, "juju-task-testing-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return dir
+}
+
+func BenchmarkContention(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("N=%d", n), func(b *testing.B) {
+			dir := benchmarkDir(b)
+			defer os.RemoveAll(dir)
+
+			var elapsed time.Duration
+
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+
+				derailleurs := make([]*Derailleur, n)
+				for j := range derailleurs {
+					derailleurs[j] = &Derailleur{
+						Dir: dir,
+					}
+					file, err := derailleurs[j].CreateWaitFile()
+					if err != nil {
+						b.Fatal(err)
+					}
+					file.Close()
+				}
+
+				// Every contender acquires and releases the lock in turn.
+				var wg sync.WaitGroup
+				errs := make(chan error, n)
+				for _, derailleur := range derailleurs {
+					wg.Add(1)
+					go func(derailleur *Derailleur) {
+						defer wg.Done()
+						err := derailleur.WaitInLine(context.Background())
+						if err != nil {
+							errs <- err
+							_ = derailleur.Abandon()
+							return
+						}
+						_ = derailleur.Release()
+					}(derailleur)
+				}
+				wg.Wait()
+
+				close(errs)
+				for err := range errs {
+					// Waiting contenders need watchers, of which there may not be enough.
+					if errors.Is(err, syscall.EMFILE) {
+						b.Skipf("not enough watchers for %d contenders: %v", n, err)
+					}
+					b.Fatal(err)
+				}
+
+				elapsed += time.Since(start)
+			}
+
+			acquires := float64(b.N * n)
+			b.ReportMetric(float64(elapsed.Nanoseconds())/acquires, "ns/acquire")
+			b.ReportMetric(acquires/elapsed.Seconds(), "acquires/s")
+		})
+	}
+}
+
+func BenchmarkAcquire(b *testing.B) {
+	for _, contended := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Contended=%t", contended), func(b *testing.B) {
+			dir := benchmarkDir(b)
+			defer os.RemoveAll(dir)
+
+			holder := Derailleur{
+				Dir: dir,
+			}
+			// Without debouncing, the contended case measures watching rather than the debounce window.
+			derailleur := Derailleur{
+				Dir:      dir,
+				Debounce: -1,
+			}
+
+			for i := 0; i < b.N; i++ {
+				if contended {
+					b.StopTimer()
+					err := holder.Lock(context.Background())
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+				}
+
+				file, err := derailleur.CreateWaitFile()
+				if err != nil {
+					b.Fatal(err)
+				}
+				file.Close()
+
+				// The holder releases the lock only after the contender has started waiting in line.
+				acquired := make(chan error, 1)
+				go func() {
+					acquired <- derailleur.WaitInLine(context.Background())
+				}()
+				if contended {
+					for {
+						if _, subscriptions := sharedWatchState(); subscriptions > 0 {
+							break
+						}
+						runtime.Gosched()
+					}
+					_ = holder.Release()
+				}
+
+				err = <-acquired
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = derailleur.Release()
+			}
+		})
+	}
+}
+
+func TestLifecycleCallbacks(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	var enqueued string
+	derailleur := Derailleur{
+		Dir: dir,
+		OnEnqueue: func(filePath string) {
+			enqueued = filePath
+			record("enqueue")
+		},
+		OnAdvance: func(position int) {
+			record(fmt.Sprintf("advance %d", position))
+		},
+		OnAcquire: func() {
+			record("acquire")
+		},
+		OnRelease: func() {
+			record("release")
+		},
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = holder.Release()
+	}()
+
+	err = derailleur.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enqueued != derailleur.FilePath {
+		t.Fatalf("expected OnEnqueue with %s, got %s", derailleur.FilePath, enqueued)
+	}
+
+	err = derailleur.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"enqueue", "advance 1", "advance 0", "acquire", "release"}
+	if strings.Join(events, ", ") != strings.Join(expected, ", ") {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+}
+
+// hidingFS is an FS whose first listing of a directory misses the file at hidden,
+// like a filesystem that doesn't list directories consistently.
+type hidingFS struct {
+	FS
+	hidden string
+	listed int32
+}
+
+func (f *hidingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	files, err := f.FS.ReadDir(name)
+	if atomic.AddInt32(&f.listed, 1) > 1 {
+		return files, err
+	}
+
+	var visible []fs.DirEntry
+	for _, file := range files {
+		if path.Join(name, file.Name()) != f.hidden {
+			visible = append(visible, file)
+		}
+	}
+	return visible, err
+}
+
+func TestVerifyAcquisition(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verify := range []bool{false, true} {
+		derailleur := Derailleur{
+			Dir:               dir,
+			FS:                &hidingFS{FS: osFS{}, hidden: holder.FilePath},
+			VerifyAcquisition: verify,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		ctx, cancelFn := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		err = derailleur.WaitInLine(ctx)
+		cancelFn()
+
+		if !verify && err != nil {
+			t.Fatalf("expected the inconsistent listing to let the contender through, got %v", err)
+		}
+		if verify && err != context.DeadlineExceeded {
+			t.Fatalf("expected the contender to keep waiting, got %v", err)
+		}
+		_ = derailleur.Release()
+	}
+}
+
+func TestSymlinkedDir(t *testing.T) {
+	target, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(target)
+
+	links, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(links)
+
+	dir := path.Join(links, "dir")
+	err = os.Symlink(target, dir)
+	if err != nil {
+		t.Skipf("can't create symbolic links: %v", err)
+	}
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	done := make(chan error)
+
+	go func() {
+		done <- derailleur.WaitInLine(context.Background())
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	err = holder.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Lock not acquired after release in a symlinked Dir.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatcherSetupLimit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify limits only apply on Linux")
+	}
+
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// Exhaust the inotify instances of the user.
+	var watchers []*fsnotify.Watcher
+	defer func() {
+		for _, watcher := range watchers {
+			watcher.Close()
+		}
+	}()
+	for len(watchers) < 10000 {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			break
+		}
+		watchers = append(watchers, watcher)
+	}
+	if len(watchers) == 10000 {
+		t.Skip("inotify instances can't be exhausted")
+	}
+
+	err = derailleur.WaitInLine(context.Background())
+	if !errors.Is(err, ErrWatcherSetup) {
+		t.Fatalf("expected ErrWatcherSetup, got %v", err)
+	}
+	if !errors.Is(err, syscall.EMFILE) {
+		t.Fatalf("expected the error to wrap EMFILE, got %v", err)
+	}
+}
+
+func TestWatchLimitExceeded(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify limits only apply on Linux")
+	}
+	if testing.Short() {
+		t.Skip("exhausting inotify watches takes a while")
+	}
+
+	data, err := os.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		t.Skip(err)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || limit > 100000 {
+		t.Skip("inotify watches can't be exhausted")
+	}
+
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// Exhaust the inotify watches of the user with a single watcher of many directories.
+	exhauster, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exhauster.Close()
+
+	filler := path.Join(dir, "filler")
+	for i := 0; ; i++ {
+		sub := path.Join(filler, strconv.Itoa(i))
+		err = os.MkdirAll(sub, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = exhauster.Add(sub)
+		if errors.Is(err, syscall.ENOSPC) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = derailleur.WaitInLine(context.Background())
+	if !errors.Is(err, ErrWatchLimitExceeded) {
+		t.Fatalf("expected ErrWatchLimitExceeded, got %v", err)
+	}
+	if !errors.Is(err, ErrWatcherSetup) {
+		t.Fatalf("expected the error to match ErrWatcherSetup, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "fs.inotify.max_user_watches") {
+		t.Fatalf("expected a hint about the sysctl, got %v", err)
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "queuer-W-0-0-0-0")
+	_, targets, err := watchTargets([]string{filePath}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && (len(targets) != 1 || filepath.Base(targets[0]) != filepath.Base(filePath)) {
+		t.Fatalf("expected the wait file to be watched, got %v", targets)
+	}
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derailleur := Derailleur{
+		Dir:        dir,
+		WatchFiles: true,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	done := make(chan error)
+
+	go func() {
+		done <- derailleur.WaitInLine(context.Background())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Lock acquired while it is held.")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = holder.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Removal of the watched wait file not noticed.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatcherErrors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "queuer-W-0-0-0-0")
+	f, _ := os.Create(filePath)
+	f.Close()
+
+	watcherErrors := make(chan error, 1)
+	derailleur := Derailleur{
+		Dir:           dir,
+		WatcherErrors: watcherErrors,
+	}
+
+	type result struct {
+		filePath string
+		err      error
+	}
+	reported := make(chan result, 1)
+
+	watcher := derailleur.watch(context.Background(), []string{filePath}, nil, func(filePath string, err error) {
+		reported <- result{filePath, err}
+	})
+	defer closeWatcher(watcher)
+
+	watcher.Errors <- fsnotify.ErrEventOverflow
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watcher error not forwarded.")
+	case err := <-watcherErrors:
+		if !errors.Is(err, fsnotify.ErrEventOverflow) {
+			t.Fatalf("expected ErrEventOverflow, got %v", err)
+		}
+	}
+
+	select {
+	case r := <-reported:
+		t.Fatalf("Watching stopped on a forwarded error: %v", r.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = os.Remove(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Removal not reported after a forwarded error.")
+	case r := <-reported:
+		if r.err != nil || r.filePath != filePath {
+			t.Fatalf("expected %s to be reported, got %q, %v", filePath, r.filePath, r.err)
+		}
+	}
+}
+
+func TestDirRemoved(t *testing.T) {
+	for _, recreate := range []bool{false, true} {
+		dir, err := os.MkdirTemp("", "juju-task-testing-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		//goland:noinspection GoDeferInLoop
+		defer os.RemoveAll(dir)
+
+		holder := Derailleur{
+			Dir: dir,
+		}
+		err = holder.Lock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		derailleur := Derailleur{
+			Dir:         dir,
+			RecreateDir: recreate,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		removed := file.Name()
+
+		done := make(chan error)
+
+		go func() {
+			done <- derailleur.WaitInLine(context.Background())
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		err = os.RemoveAll(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("Removal of the directory not noticed.")
+		case err := <-done:
+			if !recreate {
+				if !errors.Is(err, ErrDirRemoved) {
+					t.Fatalf("expected ErrDirRemoved, got %v", err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if derailleur.FilePath == removed {
+			t.Fatal("FilePath not updated to the new wait file")
+		}
+		if _, err := os.Stat(derailleur.FilePath); err != nil {
+			t.Fatalf("new wait file not created: %v", err)
+		}
+	}
+}
+
+func TestDirRecreatedBeforeWaiting(t *testing.T) {
+	for _, recreate := range []bool{false, true} {
+		dir, err := os.MkdirTemp("", "juju-task-testing-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		//goland:noinspection GoDeferInLoop
+		defer os.RemoveAll(dir)
+
+		derailleur := Derailleur{
+			Dir:         dir,
+			RecreateDir: recreate,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		removed := file.Name()
+
+		// Another contender recreates Dir before this one first waits in line. Keeping the old Dir open
+		// keeps the filesystem from reusing its inode for the new one.
+		old, err := os.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.RemoveAll(dir)
+		if err == nil {
+			err = os.Mkdir(dir, defaultDirPerm)
+		}
+		old.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = derailleur.WaitInLine(context.Background())
+		if !recreate {
+			if !errors.Is(err, ErrDirRemoved) {
+				t.Fatalf("expected ErrDirRemoved, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if derailleur.FilePath == removed {
+			t.Fatal("FilePath not updated to the new wait file")
+		}
+		if _, err := os.Stat(derailleur.FilePath); err != nil {
+			t.Fatalf("new wait file not created: %v", err)
+		}
+	}
+}
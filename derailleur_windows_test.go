@@ -0,0 +1,39 @@
+package derailleur
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWaitForFileSlashes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	temp, _ := os.Create(filepath.Join(dir, "test"))
+	temp.Close()
+
+	derailleur := Derailleur{}
+
+	// Wait file paths are joined with forward slashes, while events use backslashes.
+	fileChan := make(chan error, 1)
+	watcher := derailleur.WaitForFile(path.Join(filepath.ToSlash(dir), "test"), fileChan)
+	defer watcher.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	_ = os.Remove(temp.Name())
+
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't react to file being removed.")
+	case err := <-fileChan:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// ReapExpired removes the wait files of other lock contenders that haven't been modified for longer than TTL
+// and returns the number of removed files. It does nothing if TTL is zero.
+// Wait files that are removed by someone else in the meantime aren't counted.
+func (co *Derailleur) ReapExpired() (int, error) {
+	return co.reapExpired(co.filePath())
+}
+
+// reapExpired removes expired wait files, except for the one at own.
+func (co *Derailleur) reapExpired(own string) (int, error) {
+	if co.TTL <= 0 {
+		return 0, nil
+	}
+
+	line, err := co.line()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, filePath := range line {
+		if filePath == own {
+			continue
+		}
+
+		info, err := co.fs().Stat(filePath)
+		if err != nil || co.clock().Now().Sub(info.ModTime()) < co.TTL {
+			continue
+		}
+
+		ok, err := co.removeWaitFileIfPresent(filePath)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// Touch updates the modification time of the contender's wait file without affecting its place in line,
+// e.g. for liveness schemes other than StartHeartbeat. It returns ErrLockLost if the wait file was removed,
+// and ErrNotInQueue if the contender has no wait file.
+func (co *Derailleur) Touch() error {
+	filePath := co.filePath()
+	if filePath == "" {
+		return ErrNotInQueue
+	}
+	return co.touch(filePath)
+}
+
+// touch updates the modification time of the wait file at filePath.
+func (co *Derailleur) touch(filePath string) error {
+	now := co.clock().Now()
+	err := co.fs().Chtimes(filePath, now, now)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrLockLost
+	}
+	return err
+}
+
+// heartbeatsPerTTL is how many times per TTL the wait files of Locks are refreshed.
+const heartbeatsPerTTL = 3
+
+// StartHeartbeat periodically updates the modification time of the contender's wait file
+// so that it doesn't expire while the lock is held or waited for.
+// It keeps going until the returned stop function is called or the context is cancelled.
+// Locks from Acquire don't need it, since they keep their wait files fresh themselves.
+func (co *Derailleur) StartHeartbeat(ctx context.Context, interval time.Duration) func() {
+	// The wait file is renamed when it is marked as held, which FilePath follows.
+	return co.heartbeat(ctx, interval, co.filePath)
+}
+
+// heartbeat updates the modification time of the wait file at the path that filePath returns every interval,
+// until the returned stop function is called or the context is cancelled. Empty paths are skipped.
+func (co *Derailleur) heartbeat(ctx context.Context, interval time.Duration, filePath func() string) func() {
+	ctx, cancelFn := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				filePath := filePath()
+				if filePath == "" {
+					continue
+				}
+				err := co.touch(filePath)
+				if err != nil {
+					co.logger().Errorf("Failed to refresh wait file %s: %v", filePath, err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancelFn()
+		<-done
+	}
+}
@@ -0,0 +1,254 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReapExpired(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old, _ := os.Create(path.Join(dir, "queuer-W-0-0-0-0"))
+	old.Close()
+
+	clock := newFakeClock()
+	derailleur := Derailleur{
+		Dir:   dir,
+		TTL:   time.Minute,
+		Clock: clock,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	removed, err := derailleur.ReapExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Fatalf("expected no removed wait files before the TTL passed, got %d", removed)
+	}
+
+	clock.Advance(time.Hour)
+
+	removed, err = derailleur.ReapExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("expected 1 removed wait file, got %d", removed)
+	}
+
+	if _, err := os.Stat(old.Name()); !os.IsNotExist(err) {
+		t.Fatal("expired wait file not removed")
+	}
+	if _, err := os.Stat(derailleur.FilePath); err != nil {
+		t.Fatal("own wait file removed")
+	}
+}
+
+// racingFS is an FS on which another contender removes a wait file right after it is looked at.
+type racingFS struct {
+	FS
+	filePath string
+}
+
+func (f *racingFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := f.FS.Stat(name)
+	if name == f.filePath {
+		_ = os.Remove(name)
+	}
+	return info, err
+}
+
+func TestReapExpiredRace(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old, _ := os.Create(path.Join(dir, "queuer-W-0-0-0-0"))
+	old.Close()
+
+	clock := newFakeClock()
+	clock.Advance(time.Hour)
+	derailleur := Derailleur{
+		Dir:   dir,
+		TTL:   time.Minute,
+		Clock: clock,
+		FS:    &racingFS{FS: osFS{}, filePath: old.Name()},
+	}
+
+	// The expired wait file is gone by the time it is removed, so it doesn't count.
+	removed, err := derailleur.ReapExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Fatalf("expected no wait files to be counted as removed, got %d", removed)
+	}
+}
+
+func TestWaitInLineTTL(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A wait file that is still fresh when the contender starts waiting.
+	ahead, _ := os.Create(path.Join(dir, fmt.Sprintf("queuer-W-0-%d-0-0", time.Now().UnixNano())))
+	ahead.Close()
+
+	derailleur := Derailleur{
+		Dir: dir,
+		TTL: 500 * time.Millisecond,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	done := make(chan error)
+
+	go func() {
+		done <- derailleur.WaitInLine(context.Background())
+	}()
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expired wait file not reaped.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(ahead.Name()); !os.IsNotExist(err) {
+		t.Fatal("expired wait file not removed")
+	}
+}
+
+func TestStartHeartbeat(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+	holder := Derailleur{
+		Dir:   dir,
+		Clock: clock,
+	}
+	file, err := holder.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	stop := holder.StartHeartbeat(context.Background(), 10*time.Millisecond)
+
+	reaper := Derailleur{
+		Dir:   dir,
+		TTL:   time.Minute,
+		Clock: clock,
+	}
+
+	clock.Advance(time.Hour)
+
+	// Wait for the heartbeat to catch up with the clock.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		info, err := os.Stat(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clock.Now().Sub(info.ModTime()) < time.Minute {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("heartbeat didn't refresh the wait file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	removed, err := reaper.ReapExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Fatal("reaped a wait file that is kept alive")
+	}
+
+	stop()
+	clock.Advance(time.Hour)
+
+	removed, err = reaper.ReapExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatal("didn't reap a wait file after its heartbeat stopped")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+	derailleur := Derailleur{
+		Dir:   dir,
+		Clock: clock,
+	}
+
+	err = derailleur.Touch()
+	if !errors.Is(err, ErrNotInQueue) {
+		t.Fatalf("expected ErrNotInQueue without a wait file, got %v", err)
+	}
+
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	clock.Advance(time.Hour)
+
+	err = derailleur.Touch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clock.Now().Sub(info.ModTime()) > time.Minute {
+		t.Fatal("modification time not updated")
+	}
+
+	_ = os.Remove(file.Name())
+	err = derailleur.Touch()
+	if !errors.Is(err, ErrLockLost) {
+		t.Fatalf("expected ErrLockLost for a removed wait file, got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package derailleur
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// flock fails, as flock(2) isn't available on this platform.
+func flock(file File) error {
+	return fmt.Errorf("can't flock %s: flock isn't supported on %s", file.Name(), runtime.GOOS)
+}
+
+// funlock does nothing, as flock never succeeds on this platform.
+func funlock(File) error {
+	return nil
+}
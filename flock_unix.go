@@ -0,0 +1,35 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package derailleur
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// flock takes an exclusive advisory lock on the open wait file without blocking.
+func flock(file File) error {
+	fd, err := fileFd(file)
+	if err != nil {
+		return err
+	}
+	return syscall.Flock(int(fd), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// funlock releases the advisory lock on the open wait file.
+func funlock(file File) error {
+	fd, err := fileFd(file)
+	if err != nil {
+		return err
+	}
+	return syscall.Flock(int(fd), syscall.LOCK_UN)
+}
+
+// fileFd returns the file descriptor of the open wait file, which only files of the local filesystem have.
+func fileFd(file File) (uintptr, error) {
+	f, ok := file.(interface{ Fd() uintptr })
+	if !ok {
+		return 0, fmt.Errorf("can't flock %s: it has no file descriptor", file.Name())
+	}
+	return f.Fd(), nil
+}
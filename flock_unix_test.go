@@ -0,0 +1,69 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFlock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir:   dir,
+		Flock: true,
+	}
+
+	lock, err := derailleur.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := lock.File().(*os.File); !ok {
+		t.Fatalf("expected the wait file to be an open *os.File, got %T", lock.File())
+	}
+
+	// Another process opening the wait file can't take the flock while the lock is held.
+	other, err := os.Open(lock.FilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	err = syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if !errors.Is(err, syscall.EWOULDBLOCK) {
+		t.Fatalf("expected the wait file to be flocked, got %v", err)
+	}
+
+	err = lock.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.File() != nil {
+		t.Fatal("wait file still open after release")
+	}
+
+	err = syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		t.Fatalf("flock not released: %v", err)
+	}
+
+	// Files without a descriptor can't be flocked.
+	memory := Derailleur{
+		Dir:   dir,
+		FS:    newMemFS(),
+		Flock: true,
+	}
+	_, err = memory.Acquire(context.Background())
+	if err == nil {
+		t.Fatal("expected an error for a file without a descriptor")
+	}
+}
@@ -0,0 +1,78 @@
+package derailleur
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// FS is the filesystem on which the wait files are kept.
+// By default the local filesystem is used through the os package.
+type FS interface {
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// CreateExclusive creates a new file at name for writing and fails with an error that wraps
+	// fs.ErrExist if the file already exists, like opening it with O_CREATE|O_EXCL.
+	CreateExclusive(name string) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+}
+
+// File is a wait file opened for writing, as created by FS and returned by CreateFSWaitFile. *os.File satisfies it.
+type File interface {
+	io.WriteCloser
+	Name() string
+	Chmod(mode os.FileMode) error
+}
+
+// osFS is the FS backed by the local filesystem.
+type osFS struct{}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) CreateExclusive(name string) (File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// fs returns the filesystem used by the lock contender.
+func (co *Derailleur) fs() FS {
+	if co.FS == nil {
+		return osFS{}
+	}
+	return co.FS
+}
@@ -0,0 +1,338 @@
+package derailleur
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFS is an in-memory FS for tests that don't need to watch files.
+type memFS struct {
+	mu    sync.Mutex
+	dirs  map[string]bool
+	files map[string]*memFile
+}
+
+func newMemFS() *memFS {
+	return &memFS{
+		dirs:  map[string]bool{},
+		files: map[string]*memFile{},
+	}
+}
+
+type memFile struct {
+	fs      *memFS
+	name    string
+	data    bytes.Buffer
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.data.Write(p)
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Chmod(mode os.FileMode) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.mode = mode
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return memFileInfo{f}, nil
+}
+
+type memFileInfo struct {
+	file *memFile
+}
+
+func (i memFileInfo) Name() string       { return path.Base(i.file.name) }
+func (i memFileInfo) Size() int64        { return int64(i.file.data.Len()) }
+func (i memFileInfo) Mode() os.FileMode  { return i.file.mode }
+func (i memFileInfo) ModTime() time.Time { return i.file.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	for filePath, file := range m.files {
+		if path.Dir(filePath) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memFileInfo{file}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+
+	return nil
+}
+
+func (m *memFS) MkdirAll(name string, _ os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for ; name != "/" && name != "."; name = path.Dir(name) {
+		m.dirs[name] = true
+	}
+
+	return nil
+}
+
+func (m *memFS) CreateExclusive(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dirs[path.Dir(name)] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if _, ok := m.files[name]; ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+
+	file := &memFile{fs: m, name: name, mode: 0600, modTime: time.Now()}
+	m.files[name] = file
+
+	return file, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return memFileInfo{file}, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return append([]byte(nil), file.data.Bytes()...), nil
+}
+
+func (m *memFS) Chtimes(name string, _ time.Time, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	file.modTime = mtime
+
+	return nil
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dirs[path.Dir(name)] {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	file := &memFile{fs: m, name: name, mode: perm, modTime: time.Now()}
+	file.data.Write(data)
+	m.files[name] = file
+
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	file.name = newpath
+	m.files[newpath] = file
+
+	return nil
+}
+
+func TestMemFS(t *testing.T) {
+	memFS := newMemFS()
+
+	n := 5
+	derailleurs := make([]*Derailleur, n)
+	for i := 0; i < n; i++ {
+		derailleurs[i] = &Derailleur{
+			Dir: "/queue",
+			FS:  memFS,
+		}
+		file, err := derailleurs[i].CreateFSWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	for i, derailleur := range derailleurs {
+		position, err := derailleur.Position()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if position != i {
+			t.Fatalf("expected position %d, got %d", i, position)
+		}
+	}
+
+	info, err := derailleurs[0].HolderInfo(derailleurs[0].FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PID != os.Getpid() {
+		t.Fatalf("expected PID %d, got %d", os.Getpid(), info.PID)
+	}
+
+	contender := Derailleur{
+		Dir: "/queue",
+		FS:  memFS,
+	}
+	acquired, err := contender.TryLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acquired {
+		t.Fatal("acquired a lock that is already held")
+	}
+
+	// The in-memory files aren't an *os.File, so CreateWaitFile can't return them and leaves no wait file behind.
+	_, err = contender.CreateWaitFile()
+	if !errors.Is(err, ErrNotOSFile) {
+		t.Fatalf("expected ErrNotOSFile, got %v", err)
+	}
+	if contender.FilePath != "" {
+		t.Fatalf("expected no wait file, got %s", contender.FilePath)
+	}
+	files, _ := memFS.ReadDir("/queue")
+	if len(files) != n {
+		t.Fatalf("expected %d wait files, got %d", n, len(files))
+	}
+
+	err = derailleurs[2].CutInLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	position, err := derailleurs[2].Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 0 {
+		t.Fatalf("expected position 0 after cutting in line, got %d", position)
+	}
+
+	err = derailleurs[2].Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ = memFS.ReadDir("/queue")
+	if len(files) != 2 {
+		t.Fatalf("expected 2 remaining wait files, got %d", len(files))
+	}
+}
+
+func TestWaitInLinePolling(t *testing.T) {
+	memFS := newMemFS()
+
+	holder := Derailleur{
+		Dir: "/queue",
+		FS:  memFS,
+	}
+	file, err := holder.CreateFSWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// fsnotify can't watch the in-memory filesystem, so waiting only works by polling.
+	contender := Derailleur{
+		Dir:          "/queue",
+		FS:           memFS,
+		PollInterval: 50 * time.Millisecond,
+	}
+	file, err = contender.CreateFSWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	done := make(chan error)
+
+	go func() {
+		done <- contender.WaitInLine(context.Background())
+	}()
+
+	released := make(chan struct{})
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		close(released)
+		_ = holder.Release()
+	}()
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Didn't notice the holder releasing the lock.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-released:
+		default:
+			t.Fatal("Acquired before the holder released the lock.")
+		}
+	}
+}
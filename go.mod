@@ -2,9 +2,6 @@ module github.com/denis-ismailaj/derailleur
 
 go 1.18
 
-require (
-	github.com/fsnotify/fsnotify v1.5.4
-	github.com/sirupsen/logrus v1.8.1
-)
+require github.com/fsnotify/fsnotify v1.5.4
 
 require golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
@@ -0,0 +1,197 @@
+package derailleur
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// HolderInfo describes the process that created a wait file.
+type HolderInfo struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	CreatedAt time.Time `json:"created_at"`
+	// Payload is the Payload of the contender that created the wait file.
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// writeHolderInfo writes information about the current process, the creation time and the payload into a newly created wait file.
+func writeHolderInfo(w io.Writer, createdAt time.Time, payload []byte) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(HolderInfo{
+		PID:       os.Getpid(),
+		Hostname:  hostname,
+		CreatedAt: createdAt,
+		Payload:   payload,
+	})
+}
+
+// HolderInfo reads the information about the process that created the wait file at filePath.
+func (co *Derailleur) HolderInfo(filePath string) (HolderInfo, error) {
+	data, err := co.fs().ReadFile(filePath)
+	if err != nil {
+		return HolderInfo{}, err
+	}
+
+	return parseHolderInfo(data)
+}
+
+// ReadPayload reads the Payload that the contender with the wait file at filePath was created with.
+// It is empty if the contender had no Payload.
+func (co *Derailleur) ReadPayload(filePath string) ([]byte, error) {
+	info, err := co.HolderInfo(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return info.Payload, nil
+}
+
+// parseHolderInfo parses the holder information in the contents of a wait file.
+func parseHolderInfo(data []byte) (HolderInfo, error) {
+	var info HolderInfo
+	err := json.Unmarshal(data, &info)
+	return info, err
+}
+
+// ReapStale removes the wait files of lock contenders whose processes are no longer running
+// and returns the number of removed files. Wait files that are removed by someone else in the meantime aren't counted.
+// Only wait files created on this host are considered, and files whose holder information
+// can't be read are left untouched.
+func (co *Derailleur) ReapStale() (int, error) {
+	line, err := co.line()
+	if err != nil {
+		return 0, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, filePath := range line {
+		info, err := co.HolderInfo(filePath)
+		if err != nil || info.Hostname != hostname || processAlive(info.PID) {
+			continue
+		}
+
+		ok, err := co.removeWaitFileIfPresent(filePath)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// Compact removes the wait files in Dir that are older than maxAge and have no live owner, e.g. the leftovers
+// of crashed processes that slow down listing the line, and returns the number of removed files.
+// Unlike ReapStale, it covers the wait files of every lock in Dir, as well as wait files that were left behind
+// while being released with RenameOnRelease. The age of a wait file is the time since it was last modified,
+// so wait files that are kept alive with StartHeartbeat or Touch are never old.
+// A wait file has a live owner if its holder information names a running process on this host or another host,
+// whose processes can't be checked. Wait files whose owner can't be determined, because their holder information
+// can't be read, e.g. legacy wait files or ones whose contender is just writing it, are left alone,
+// so only files of this host whose processes are no longer running are removed.
+func (co *Derailleur) Compact(maxAge time.Duration) (int, error) {
+	var files []fs.DirEntry
+	err := co.retry(func() error {
+		var err error
+		files, err = co.fs().ReadDir(co.Dir)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+
+	now := co.clock().Now()
+	removed := 0
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, co.prefix()+"-") {
+			continue
+		}
+
+		filePath := path.Join(co.Dir, name)
+		releasing := strings.HasSuffix(name, releasingSuffix)
+		if _, ok := parseWaitFileName(co.prefix(), name); !ok && !releasing {
+			continue
+		}
+
+		stat, err := co.fs().Stat(filePath)
+		if err != nil || now.Sub(stat.ModTime()) < maxAge {
+			continue
+		}
+
+		var ok bool
+		if releasing {
+			// A wait file that is being released has no owner anymore, and is out of line already.
+			err = co.retry(func() error {
+				return co.fs().Remove(filePath)
+			})
+			ok = err == nil
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			info, infoErr := co.HolderInfo(filePath)
+			if infoErr != nil || info.Hostname != hostname || processAlive(info.PID) {
+				continue
+			}
+			ok, err = co.removeWaitFileIfPresent(filePath)
+		}
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// recoverOwnFiles removes the wait files of the lock that were created by a process
+// with the same PID as the current one on this host.
+func (co *Derailleur) recoverOwnFiles() error {
+	line, err := co.line()
+	if err != nil {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	for _, filePath := range line {
+		info, err := co.HolderInfo(filePath)
+		if err != nil || info.Hostname != hostname || info.PID != os.Getpid() {
+			continue
+		}
+
+		err = co.removeWaitFile(filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package derailleur
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestHolderInfo(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	before := time.Now()
+
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	info, err := derailleur.HolderInfo(derailleur.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostname, _ := os.Hostname()
+
+	if info.PID != os.Getpid() {
+		t.Fatalf("expected PID %d, got %d", os.Getpid(), info.PID)
+	}
+	if info.Hostname != hostname {
+		t.Fatalf("expected hostname %s, got %s", hostname, info.Hostname)
+	}
+	if info.CreatedAt.Before(before) || info.CreatedAt.After(time.Now()) {
+		t.Fatalf("unexpected creation time %s", info.CreatedAt)
+	}
+}
+
+func TestReapStale(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Get the PID of a process that is known to have exited.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPID := cmd.Process.Pid
+
+	hostname, _ := os.Hostname()
+
+	stale := path.Join(dir, "queuer-W-0-0-0-0")
+	data, _ := json.Marshal(HolderInfo{PID: deadPID, Hostname: hostname, CreatedAt: time.Now()})
+	err = os.WriteFile(stale, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unparsable := path.Join(dir, "queuer-W-0-1-0-0")
+	err = os.WriteFile(unparsable, []byte("not json"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// The stale wait file is removed like a released one.
+	releasing := &releasingFS{FS: osFS{}, failures: 1}
+	reaper := Derailleur{
+		Dir:             dir,
+		FS:              releasing,
+		RenameOnRelease: true,
+		Retry: RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     time.Millisecond,
+		},
+	}
+	removed, err := reaper.ReapStale()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("expected 1 removed wait file, got %d", removed)
+	}
+
+	checkReleased(t, releasing, dir, []string{stale})
+	if _, err := os.Stat(unparsable); err != nil {
+		t.Fatal("unparsable wait file removed")
+	}
+	if _, err := os.Stat(derailleur.FilePath); err != nil {
+		t.Fatal("live wait file removed")
+	}
+}
+
+func TestRecoverOwnFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostname, _ := os.Hostname()
+
+	// A wait file left behind by a former process that had the same PID.
+	own := path.Join(dir, "queuer-W-0-0-0-0")
+	data, _ := json.Marshal(HolderInfo{PID: os.Getpid(), Hostname: hostname, CreatedAt: time.Now()})
+	err = os.WriteFile(own, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := path.Join(dir, "queuer-W-0-1-0-0")
+	data, _ = json.Marshal(HolderInfo{PID: os.Getpid() + 1, Hostname: hostname, CreatedAt: time.Now()})
+	err = os.WriteFile(other, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derailleur := Derailleur{
+		Dir:             dir,
+		RecoverOwnFiles: true,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if _, err := os.Stat(own); !os.IsNotExist(err) {
+		t.Fatal("wait file of the same PID not removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatal("wait file of another process removed")
+	}
+
+	position, err := derailleur.Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 1 {
+		t.Fatalf("expected position 1, got %d", position)
+	}
+}
+
+func TestReadPayload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir:     dir,
+		Payload: []byte("job-42"),
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	other := Derailleur{
+		Dir: dir,
+	}
+	file, err = other.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	payload, err := other.ReadPayload(derailleur.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "job-42" {
+		t.Fatalf("expected payload %q, got %q", "job-42", payload)
+	}
+
+	payload, err = derailleur.ReadPayload(other.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) != 0 {
+		t.Fatalf("expected no payload, got %q", payload)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Get the PID of a process that is known to have exited.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPID := cmd.Process.Pid
+
+	hostname, _ := os.Hostname()
+
+	files := map[string]HolderInfo{
+		"queuer-W-0-0-0-0":                   {PID: deadPID, Hostname: hostname},
+		"queuer-lockA-R-0-0-0-0":             {PID: deadPID, Hostname: hostname},
+		"queuer-W-0-1-0-0" + releasingSuffix: {PID: os.Getpid(), Hostname: hostname},
+		"queuer-W-0-2-0-0":                   {PID: deadPID, Hostname: hostname + "-other"},
+		"unrelated":                          {PID: deadPID, Hostname: hostname},
+	}
+	for name, info := range files {
+		data, _ := json.Marshal(info)
+		err = os.WriteFile(path.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unparsable := path.Join(dir, "queuer-W-0-3-0-0")
+	err = os.WriteFile(unparsable, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A legacy wait file of a contender that didn't write holder information.
+	legacy := path.Join(dir, "queuer-1000-1")
+	err = os.WriteFile(legacy, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := newFakeClock()
+	releasing := &releasingFS{FS: osFS{}, failures: 1}
+	derailleur := Derailleur{
+		Dir:             dir,
+		Clock:           clock,
+		FS:              releasing,
+		RenameOnRelease: true,
+		Retry: RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     time.Millisecond,
+		},
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	clock.Advance(time.Hour)
+
+	removed, err := derailleur.Compact(2 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Fatalf("expected no removed files younger than the maximum age, got %d", removed)
+	}
+
+	removed, err = derailleur.Compact(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Fatalf("expected 3 removed files, got %d", removed)
+	}
+
+	// The wait files are removed like released ones, while the one that was being released is just removed.
+	checkReleased(t, releasing, dir, []string{path.Join(dir, "queuer-W-0-0-0-0"), path.Join(dir, "queuer-lockA-R-0-0-0-0")})
+	if _, err := os.Stat(path.Join(dir, "queuer-W-0-1-0-0"+releasingSuffix)); !os.IsNotExist(err) {
+		t.Fatal("wait file that was being released not removed")
+	}
+
+	// The owners of wait files without holder information can't be determined.
+	for _, filePath := range []string{unparsable, legacy} {
+		if _, err := os.Stat(filePath); err != nil {
+			t.Fatalf("wait file without holder information %s removed", filePath)
+		}
+	}
+	for _, name := range []string{"queuer-W-0-2-0-0", "unrelated"} {
+		if _, err := os.Stat(path.Join(dir, name)); err != nil {
+			t.Fatalf("%s removed", name)
+		}
+	}
+	if _, err := os.Stat(derailleur.FilePath); err != nil {
+		t.Fatal("live wait file removed")
+	}
+}
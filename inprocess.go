@@ -0,0 +1,62 @@
+package derailleur
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+)
+
+// gateKey identifies a lock for which the InProcess contenders of this process queue in memory.
+type gateKey struct {
+	dir   string
+	name  string
+	limit int
+}
+
+var (
+	// gatesMu guards gates.
+	gatesMu sync.Mutex
+	// gates holds a channel for every lock that InProcess contenders of this process have used.
+	// Its capacity is the number of contenders that may wait in line with wait files at a time.
+	gates = map[gateKey]chan struct{}{}
+)
+
+// gate returns the channel through which the contender has to pass before creating a wait file,
+// or nil if it doesn't queue in memory.
+func (co *Derailleur) gate() chan struct{} {
+	if !co.InProcess || co.Mode != Exclusive {
+		return nil
+	}
+
+	dir, err := filepath.Abs(co.Dir)
+	if err != nil {
+		dir = filepath.Clean(co.Dir)
+	}
+	key := gateKey{dir: dir, name: co.Name, limit: co.limit()}
+
+	gatesMu.Lock()
+	defer gatesMu.Unlock()
+
+	gate, ok := gates[key]
+	if !ok {
+		gate = make(chan struct{}, co.limit())
+		gates[key] = gate
+	}
+	return gate
+}
+
+// enterGate blocks until the contender may wait in line with a wait file, and returns the function
+// that lets the next contender of this process in once the lock is released.
+func (co *Derailleur) enterGate(ctx context.Context) (func(), error) {
+	gate := co.gate()
+	if gate == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case gate <- struct{}{}:
+		return func() { <-gate }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
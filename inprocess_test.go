@@ -0,0 +1,111 @@
+package derailleur
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInProcess(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := &Derailleur{
+		Dir:       dir,
+		InProcess: true,
+	}
+	// Stands in for another process with a single contender, which takes turns through the wait files only.
+	other := &Derailleur{
+		Dir: dir,
+	}
+
+	n := 20
+	var holders int32
+	var wg sync.WaitGroup
+
+	hold := func(co *Derailleur) {
+		defer wg.Done()
+
+		lock, err := co.Acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer lock.Release()
+
+		if atomic.AddInt32(&holders, 1) > 1 {
+			t.Error("lock held by more than one contender")
+		}
+		defer atomic.AddInt32(&holders, -1)
+
+		// Only one contender of this process and the other one are in line at a time.
+		line, err := co.line()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(line) > 2 {
+			t.Errorf("expected at most 2 wait files, got %d", len(line))
+		}
+	}
+
+	wg.Add(n + 1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			hold(other)
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		go hold(derailleur)
+	}
+
+	wg.Wait()
+}
+
+func TestInProcessCancel(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := &Derailleur{
+		Dir:       dir,
+		InProcess: true,
+	}
+
+	err = derailleur.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A contender that gives up while queueing in memory doesn't take the place of the next one.
+	ctx, cancelFn := context.WithCancel(context.Background())
+	cancelFn()
+	_, err = derailleur.Acquire(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	err = derailleur.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := derailleur.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lock.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
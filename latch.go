@@ -0,0 +1,134 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// latchFilePrefix is the prefix of the names of latch marker files.
+const latchFilePrefix = "latch-"
+
+// Latch blocks waiting parties, e.g. processes, until a count reaches zero.
+// The count is the number of marker files for the latch in Dir, and it is only ever counted down.
+type Latch struct {
+	Dir string
+
+	// Name identifies the latch, so that it can share Dir with locks and other latches.
+	// It must not contain dashes or path separators.
+	Name string
+}
+
+// NewLatch creates a latch in dir with the given initial count.
+// Other parties can use the same latch by creating a Latch with the same Dir and Name.
+func NewLatch(dir string, count int) (*Latch, error) {
+	latch := &Latch{
+		Dir: dir,
+	}
+	err := latch.Init(count)
+	if err != nil {
+		return nil, err
+	}
+	return latch, nil
+}
+
+// Init increases the count of the latch by creating the given number of marker files.
+func (l *Latch) Init(count int) error {
+	err := validateName(l.Name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(l.Dir, defaultDirPerm)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		file, err := os.CreateTemp(l.Dir, l.markerPrefix()+"*")
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+
+	return nil
+}
+
+// CountDown decreases the count of the latch by removing one of its marker files.
+// It returns an error if the count is already zero.
+func (l *Latch) CountDown() error {
+	for {
+		markers, err := l.markers()
+		if err != nil {
+			return err
+		}
+		if len(markers) == 0 {
+			return errors.New("latch count is already zero")
+		}
+
+		// Another party may have removed the same marker in the meantime, in which case another one is tried.
+		err = os.Remove(markers[0])
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+}
+
+// Await blocks until the count of the latch reaches zero.
+func (l *Latch) Await(ctx context.Context) error {
+	for {
+		// Set up the watcher before checking, so that no removal is missed in between.
+		changed := make(chan error, 1)
+		watcher := watchDir(l.Dir, changed)
+
+		markers, err := l.markers()
+		if err != nil || len(markers) == 0 {
+			closeWatcher(watcher)
+			return err
+		}
+
+		select {
+		case err = <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		closeWatcher(watcher)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// markerPrefix returns the prefix of the names of the marker files of the latch.
+func (l *Latch) markerPrefix() string {
+	if l.Name == "" {
+		return latchFilePrefix
+	}
+	return latchFilePrefix + l.Name + "-"
+}
+
+// markers returns the paths of the remaining marker files of the latch.
+func (l *Latch) markers() ([]string, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := l.markerPrefix()
+
+	var markers []string
+	for _, entry := range entries {
+		name := entry.Name()
+		// Marker files of other latches have another name in between.
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !isNumber(strings.TrimPrefix(name, prefix)) {
+			continue
+		}
+		markers = append(markers, filepath.Join(l.Dir, name))
+	}
+
+	return markers, nil
+}
@@ -0,0 +1,68 @@
+package derailleur
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	latch, err := NewLatch(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A latch with another name doesn't count towards this one.
+	other := Latch{Dir: dir, Name: "other"}
+	err = other.Init(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- latch.Await(context.Background())
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+			t.Fatal("Await returned before the count reached zero.")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		err = latch.CountDown()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Await not returning after the count reached zero.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = latch.CountDown()
+	if err == nil {
+		t.Fatal("expected an error counting down past zero")
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFn()
+
+	err = other.Await(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
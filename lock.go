@@ -0,0 +1,199 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Lock is a handle to a lock acquired with Acquire.
+// Unlike the FilePath of a Derailleur, every Lock has its own wait file,
+// so a single Derailleur can hold several locks and release each of them independently.
+type Lock struct {
+	co       *Derailleur
+	filePath string
+	token    uint64
+	// file is the wait file, which is kept open until the lock is released.
+	file File
+	// flocked is set if file is locked with flock.
+	flocked bool
+	// leaveGate lets the next InProcess contender in once the lock is released.
+	leaveGate func()
+	// stopHeartbeat stops refreshing the wait file if TTL is set.
+	stopHeartbeat func()
+}
+
+// FilePath returns the path of the wait file of the lock.
+func (l *Lock) FilePath() string {
+	return l.filePath
+}
+
+// File returns the wait file of the lock, which is kept open from its creation until the lock is released.
+// With the default FS it is an *os.File, whose Fd can be used to layer other advisory locks on top of the lock.
+// It is nil once the lock is released, and on Windows, where open files can't be removed,
+// so that wait files aren't kept open there.
+func (l *Lock) File() File {
+	return l.file
+}
+
+// Touch updates the modification time of the wait file of the lock without affecting its place in line, like the Touch
+// of a Derailleur. With a TTL, Locks keep their wait files fresh themselves, so it is only needed for other liveness schemes.
+// It returns ErrLockLost if the wait file was removed.
+func (l *Lock) Touch() error {
+	return l.co.touch(l.filePath)
+}
+
+// Release removes the wait file of the lock, releasing it, after unlocking and closing the open wait file.
+// Releasing a lock whose wait file was already removed is not an error.
+func (l *Lock) Release() error {
+	if l.stopHeartbeat != nil {
+		l.stopHeartbeat()
+		l.stopHeartbeat = nil
+	}
+	if l.file != nil {
+		if l.flocked {
+			_ = funlock(l.file)
+		}
+		l.file.Close()
+		l.file = nil
+	}
+
+	err := l.co.removeWaitFile(l.filePath)
+	if err != nil {
+		return err
+	}
+	l.co.metrics().IncReleased()
+	if l.co.OnRelease != nil {
+		l.co.OnRelease()
+	}
+
+	if l.leaveGate != nil {
+		l.leaveGate()
+		l.leaveGate = nil
+	}
+
+	return nil
+}
+
+// Acquire creates a new wait file and blocks until it is the first in line.
+// The wait file is kept open until the lock is released, see Lock.File.
+// If waiting fails before the lock is acquired, the wait file is removed.
+// The returned Lock carries a new fencing token.
+// If TTL is set, the wait file is refreshed a few times per TTL while waiting and until the lock is released,
+// so that other contenders don't remove it as expired.
+// The FilePath of the Derailleur is not used or modified.
+func (co *Derailleur) Acquire(ctx context.Context) (*Lock, error) {
+	return co.acquire(ctx, co.Payload)
+}
+
+// AcquireWithPayload is like Acquire, but the wait file carries the given payload instead of the Payload
+// of the Derailleur, e.g. to tell other processes what the lock is held for. It can be read with ReadPayload.
+func (co *Derailleur) AcquireWithPayload(ctx context.Context, payload []byte) (*Lock, error) {
+	return co.acquire(ctx, payload)
+}
+
+// AcquireDeadline is like Acquire, but gives up and returns ErrTimeout if the lock isn't acquired by the deadline.
+// The deadline covers everything up to acquiring the lock, including creating the wait file.
+// On timeout the wait file is removed, so the contender no longer holds a place in line.
+func (co *Derailleur) AcquireDeadline(ctx context.Context, deadline time.Time) (*Lock, error) {
+	deadlineCtx, cancelFn := context.WithDeadline(ctx, deadline)
+	defer cancelFn()
+
+	lock, err := co.acquire(deadlineCtx, co.Payload)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, ErrTimeout
+	}
+
+	return lock, err
+}
+
+// acquire creates a new wait file with the payload and blocks until it is the first in line.
+func (co *Derailleur) acquire(ctx context.Context, payload []byte) (*Lock, error) {
+	leaveGate, err := co.enterGate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	file, filePath, err := co.createLockFile(payload)
+	if err != nil {
+		leaveGate()
+		return nil, err
+	}
+
+	// The heartbeat follows the wait file when it is recreated, and once it is marked as held.
+	var mu sync.Mutex
+	current := filePath
+	setCurrent := func(filePath string) {
+		mu.Lock()
+		defer mu.Unlock()
+		current = filePath
+	}
+	stopHeartbeat := func() {}
+	if co.TTL > 0 {
+		stopHeartbeat = co.heartbeat(context.Background(), co.TTL/heartbeatsPerTTL, func() string {
+			mu.Lock()
+			defer mu.Unlock()
+			return current
+		})
+	}
+
+	filePath, err = co.waitInLine(ctx, filePath, func() (string, error) {
+		newFile, newPath, err := co.createLockFile(payload)
+		if err != nil {
+			return "", err
+		}
+		closeFile(file)
+		file = newFile
+		setCurrent(newPath)
+		return newPath, nil
+	})
+	setCurrent(filePath)
+	var token uint64
+	if err == nil {
+		token, err = co.nextToken()
+	}
+	if err != nil {
+		stopHeartbeat()
+		closeFile(file)
+		_ = co.removeWaitFile(filePath)
+		leaveGate()
+		return nil, err
+	}
+
+	return &Lock{co: co, filePath: filePath, token: token, file: file, flocked: co.Flock, leaveGate: leaveGate,
+		stopHeartbeat: stopHeartbeat}, nil
+}
+
+// createLockFile creates a new wait file with the payload for a Lock and takes a flock on it if Flock is set.
+// The wait file is returned open, except on Windows, where it is closed and nil is returned with its path,
+// so that other contenders can still remove it.
+func (co *Derailleur) createLockFile(payload []byte) (File, string, error) {
+	file, err := co.createWaitFileWithPayload(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if co.Flock {
+		err = flock(file)
+		if err != nil {
+			file.Close()
+			_ = co.fs().Remove(file.Name())
+			return nil, "", err
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		file.Close()
+		return nil, file.Name(), nil
+	}
+	return file, file.Name(), nil
+}
+
+// closeFile closes file unless it is nil.
+func closeFile(file File) {
+	if file != nil {
+		file.Close()
+	}
+}
@@ -0,0 +1,279 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAcquire(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	first, err := derailleur.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derailleur.FilePath != "" {
+		t.Fatal("Acquire modified FilePath")
+	}
+
+	acquired := make(chan *Lock)
+
+	go func() {
+		second, err := derailleur.Acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- second
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired a lock that is already held")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	err = first.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Second lock not acquired after releasing the first.")
+	case second := <-acquired:
+		if second.FilePath() == first.FilePath() {
+			t.Fatal("both locks share a wait file")
+		}
+		err = second.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, _ := derailleur.List()
+	if len(entries) != 0 {
+		t.Fatal("wait files left after releasing all locks")
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := &Derailleur{
+		Dir: dir,
+	}
+
+	n := 10
+	done := make(chan struct{})
+
+	for i := 0; i < n; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			lock, err := derailleur.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			err = lock.Release()
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			file, err := derailleur.CreateWaitFile()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			file.Close()
+			_, _ = derailleur.Position()
+			_, _ = derailleur.ReapExpired()
+			err = os.Remove(file.Name())
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	for i := 0; i < 2*n; i++ {
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatal("Concurrent contenders not finishing.")
+		case <-done:
+		}
+	}
+}
+
+func TestAcquireWithPayload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir:     dir,
+		Payload: []byte("default"),
+	}
+
+	lock, err := derailleur.AcquireWithPayload(context.Background(), []byte("job 42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := derailleur.ReadPayload(lock.FilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "job 42" {
+		t.Fatalf("expected payload %q, got %q", "job 42", payload)
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFn()
+
+	_, err = derailleur.AcquireWithPayload(ctx, []byte("job 43"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context's error, got %v", err)
+	}
+
+	entries, _ := derailleur.List()
+	if len(entries) != 1 {
+		t.Fatalf("expected only the held lock in line after cancellation, got %d contenders", len(entries))
+	}
+
+	err = lock.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ = derailleur.List()
+	if len(entries) != 0 {
+		t.Fatal("wait file left after releasing the lock")
+	}
+}
+
+func TestAcquireDeadline(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	lock, err := derailleur.AcquireDeadline(context.Background(), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = derailleur.AcquireDeadline(context.Background(), time.Now().Add(200*time.Millisecond))
+	if err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+
+	entries, _ := derailleur.List()
+	if len(entries) != 1 || entries[0].FilePath != lock.FilePath() {
+		t.Fatalf("expected only the held lock in line after the deadline, got %d contenders", len(entries))
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	cancelFn()
+
+	_, err = derailleur.AcquireDeadline(ctx, time.Now().Add(time.Minute))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the context's error, got %v", err)
+	}
+
+	err = lock.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err = derailleur.AcquireDeadline(context.Background(), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("lock not acquired after the holder released it: %v", err)
+	}
+	_ = lock.Release()
+}
+
+func TestAcquireTTL(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+		TTL: 300 * time.Millisecond,
+	}
+	lock, err := derailleur.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The holder keeps its wait file fresh, so a contender that waits for longer than TTL doesn't remove it.
+	done := make(chan *Lock)
+	go func() {
+		lock, err := derailleur.Acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		done <- lock
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("acquired a lock whose holder keeps its wait file fresh")
+	case <-time.After(time.Second):
+	}
+
+	err = lock.Touch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = lock.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lock.Touch()
+	if !errors.Is(err, ErrLockLost) {
+		t.Fatalf("expected ErrLockLost after releasing, got %v", err)
+	}
+
+	select {
+	case lock := <-done:
+		if lock == nil {
+			t.FailNow()
+		}
+		err = lock.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("didn't acquire the lock after it was released")
+	}
+}
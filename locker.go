@@ -0,0 +1,37 @@
+package derailleur
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Locker adapts a Derailleur to sync.Locker, so that it can be used by code that expects one.
+type Locker struct {
+	co *Derailleur
+}
+
+var _ sync.Locker = (*Locker)(nil)
+
+// Locker returns a Locker that locks and unlocks the Derailleur.
+func (co *Derailleur) Locker() *Locker {
+	return &Locker{co: co}
+}
+
+// Lock creates a wait file and blocks until the lock is acquired, without a way to give up waiting.
+// Since sync.Locker can't return an error, Lock panics if the lock can't be acquired,
+// e.g. when Dir can't be read or the wait file is removed by another contender cutting in line.
+func (l *Locker) Lock() {
+	err := l.co.Lock(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("derailleur: failed to lock: %v", err))
+	}
+}
+
+// Unlock releases the lock. Like Lock, it panics if the wait file can't be removed.
+func (l *Locker) Unlock() {
+	err := l.co.Release()
+	if err != nil {
+		panic(fmt.Sprintf("derailleur: failed to unlock: %v", err))
+	}
+}
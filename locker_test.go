@@ -0,0 +1,46 @@
+package derailleur
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLocker(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 10
+	var holders, acquired int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Each goroutine needs its own Derailleur, since it holds only one wait file.
+			var locker sync.Locker = (&Derailleur{Dir: dir}).Locker()
+			locker.Lock()
+			defer locker.Unlock()
+
+			if atomic.AddInt32(&holders, 1) > 1 {
+				t.Error("lock held by more than one goroutine")
+			}
+			runtime.Gosched()
+			atomic.AddInt32(&holders, -1)
+			atomic.AddInt32(&acquired, 1)
+		}()
+	}
+
+	wg.Wait()
+
+	if acquired != int32(n) {
+		t.Fatalf("expected the lock to be acquired %d times, got %d", n, acquired)
+	}
+}
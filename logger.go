@@ -0,0 +1,30 @@
+package derailleur
+
+// Logger is used by Derailleur to report on its progress.
+// It is satisfied by the loggers of most logging packages, e.g. *logrus.Logger.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// noopLogger is the Logger that is used when none is configured. It discards everything.
+type noopLogger struct{}
+
+func (noopLogger) Infof(string, ...interface{}) {}
+
+func (noopLogger) Errorf(string, ...interface{}) {}
+
+// logger returns the Logger of the lock contender.
+func (co *Derailleur) logger() Logger {
+	if co.Logger == nil {
+		return noopLogger{}
+	}
+	return co.Logger
+}
+
+// verbosef logs a message about the progress of waiting in line if Verbose is set.
+func (co *Derailleur) verbosef(format string, args ...interface{}) {
+	if co.Verbose {
+		co.logger().Infof(format, args...)
+	}
+}
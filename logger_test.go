@@ -0,0 +1,62 @@
+package derailleur
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+// recordingLogger is a Logger that keeps all messages for inspection.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.Infof(format, args...)
+}
+
+func TestLogger(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := &recordingLogger{}
+
+	derailleur := Derailleur{
+		Dir:    dir,
+		Logger: logger,
+	}
+
+	err = derailleur.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = derailleur.Release()
+
+	if len(logger.messages) != 0 {
+		t.Fatalf("unexpected log messages without Verbose %q", logger.messages)
+	}
+
+	derailleur.Verbose = true
+
+	err = derailleur.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer derailleur.Release()
+
+	if len(logger.messages) != 1 || logger.messages[0] != "First in line." {
+		t.Fatalf("unexpected log messages %q", logger.messages)
+	}
+}
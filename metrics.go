@@ -0,0 +1,35 @@
+package derailleur
+
+import "time"
+
+// Metrics receives measurements of the lock, e.g. to export them to Prometheus.
+type Metrics interface {
+	// ObserveWaitDuration is called with how long a lock contender waited in line once it acquires the lock.
+	ObserveWaitDuration(d time.Duration)
+	// SetQueueDepth is called with the number of lock contenders in line, including the holders,
+	// every time a waiting contender checks the line.
+	SetQueueDepth(depth int)
+	// IncAcquired is called every time the lock is acquired.
+	IncAcquired()
+	// IncReleased is called every time the lock is released.
+	IncReleased()
+}
+
+// noopMetrics is the Metrics that is used when none is configured. It discards everything.
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveWaitDuration(time.Duration) {}
+
+func (noopMetrics) SetQueueDepth(int) {}
+
+func (noopMetrics) IncAcquired() {}
+
+func (noopMetrics) IncReleased() {}
+
+// metrics returns the Metrics of the lock contender.
+func (co *Derailleur) metrics() Metrics {
+	if co.Metrics == nil {
+		return noopMetrics{}
+	}
+	return co.Metrics
+}
@@ -0,0 +1,97 @@
+package derailleur
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics is a Metrics that keeps all measurements for inspection.
+type recordingMetrics struct {
+	mu            sync.Mutex
+	waitDurations []time.Duration
+	depths        []int
+	acquired      int
+	released      int
+}
+
+func (m *recordingMetrics) ObserveWaitDuration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waitDurations = append(m.waitDurations, d)
+}
+
+func (m *recordingMetrics) SetQueueDepth(depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.depths = append(m.depths, depth)
+}
+
+func (m *recordingMetrics) IncAcquired() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acquired++
+}
+
+func (m *recordingMetrics) IncReleased() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.released++
+}
+
+func TestMetrics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := &recordingMetrics{}
+	derailleur := Derailleur{
+		Dir:     dir,
+		Metrics: metrics,
+	}
+
+	// A failed attempt neither acquires nor releases the lock.
+	ok, err := derailleur.TryLock()
+	if err != nil || ok {
+		t.Fatalf("expected TryLock to fail, got %t, %v", ok, err)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = holder.Release()
+	}()
+
+	err = derailleur.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = derailleur.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if metrics.acquired != 1 || metrics.released != 1 {
+		t.Fatalf("expected 1 acquisition and 1 release, got %d and %d", metrics.acquired, metrics.released)
+	}
+	if len(metrics.waitDurations) != 1 || metrics.waitDurations[0] < 200*time.Millisecond {
+		t.Fatalf("expected a wait duration of at least 200ms, got %v", metrics.waitDurations)
+	}
+	if len(metrics.depths) < 2 || metrics.depths[0] != 2 || metrics.depths[len(metrics.depths)-1] != 1 {
+		t.Fatalf("expected the queue depth to go from 2 to 1, got %v", metrics.depths)
+	}
+}
@@ -0,0 +1,127 @@
+package derailleur
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Migrate moves the wait files with the default Prefix of all locks from oldDir to newDir, e.g. when lock contenders
+// are moved to another shared volume. newDir is created if it doesn't exist. The wait files keep their names,
+// and with them their places in line, so if newDir already contains wait files, the two lines are merged
+// in the order in which their wait files were created. The files that keep the fencing tokens of the locks are moved
+// as well, so that tokens keep increasing in newDir. If newDir already has a fencing token of a lock,
+// the higher one of the two is kept. Other files are left in oldDir.
+//
+// Each wait file is moved atomically with a rename, so oldDir and newDir have to be on the same filesystem,
+// but the migration as a whole isn't atomic. Nothing is moved if a wait file with the same name already exists
+// in newDir. Lock contenders that are waiting in oldDir see their wait files disappear as if they were removed:
+// they have to be pointed at newDir, with their FilePath in newDir, and check the line again, e.g. by calling
+// WaitInLine again. Merging can put a wait file from oldDir ahead of a holder in newDir, so it is best done
+// while no lock is held in either directory.
+func Migrate(oldDir, newDir string) error {
+	files, err := os.ReadDir(oldDir)
+	if err != nil {
+		return err
+	}
+
+	var waitFiles []waitFile
+	var tokenFiles []string
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if isTokenFileName(f.Name()) {
+			tokenFiles = append(tokenFiles, f.Name())
+			continue
+		}
+		name, ok := parseWaitFileName(defaultPrefix, f.Name())
+		if !ok {
+			continue
+		}
+		waitFiles = append(waitFiles, waitFile{filepath.Join(oldDir, f.Name()), name})
+	}
+
+	err = os.MkdirAll(newDir, defaultDirPerm)
+	if err != nil {
+		return err
+	}
+
+	// Check for conflicts up front, so that a conflict doesn't leave the wait files split between the directories.
+	for _, f := range waitFiles {
+		newPath := filepath.Join(newDir, filepath.Base(f.path))
+		_, err := os.Lstat(newPath)
+		if err == nil {
+			return fmt.Errorf("can't migrate %s: %s already exists", f.path, newPath)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// Move the fencing tokens first, so that no contender in newDir can get a token that was already issued in oldDir.
+	for _, name := range tokenFiles {
+		err := migrateToken(filepath.Join(oldDir, name), filepath.Join(newDir, name))
+		if err != nil {
+			return fmt.Errorf("can't migrate %s: %w", name, err)
+		}
+	}
+
+	// Move the wait files in line order, so that the line in oldDir is moved from its head,
+	// which keeps the contenders that are first in line first while they are being moved.
+	ordering{}.sort(waitFiles)
+	for _, f := range waitFiles {
+		err := os.Rename(f.path, filepath.Join(newDir, filepath.Base(f.path)))
+		if errors.Is(err, os.ErrNotExist) {
+			// The wait file was removed in the meantime, so its contender left the line.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("can't migrate %s: %w", f.path, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateToken moves the fencing token file at oldPath to newPath. If there is a fencing token file at newPath already,
+// it keeps the higher one of the two tokens.
+func migrateToken(oldPath, newPath string) error {
+	data, err := os.ReadFile(oldPath)
+	if err != nil {
+		return err
+	}
+	oldToken, err := parseToken(data)
+	if err != nil {
+		return err
+	}
+
+	data, err = os.ReadFile(newPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.Rename(oldPath, newPath)
+	}
+	if err != nil {
+		return err
+	}
+	newToken, err := parseToken(data)
+	if err != nil {
+		return err
+	}
+
+	if oldToken > newToken {
+		// Replace the file atomically, like nextToken does.
+		tempPath := tokenTempPath(newPath)
+		err = os.WriteFile(tempPath, []byte(strconv.FormatUint(oldToken, 10)), defaultFilePerm)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tempPath, newPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(oldPath)
+}
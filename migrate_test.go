@@ -0,0 +1,154 @@
+package derailleur
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	oldDir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(oldDir)
+
+	parent, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	newDir := path.Join(parent, "new")
+
+	for _, name := range []string{"queuer-W-0-1000-0-0", "queuer-lockA-W-0-5-0-0", "unrelated"} {
+		f, _ := os.Create(path.Join(oldDir, name))
+		f.Close()
+	}
+
+	err = Migrate(oldDir, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := os.ReadDir(oldDir)
+	if len(files) != 1 || files[0].Name() != "unrelated" {
+		t.Fatalf("expected only the unrelated file to be left behind, got %d files", len(files))
+	}
+	for _, name := range []string{"queuer-W-0-1000-0-0", "queuer-lockA-W-0-5-0-0"} {
+		if _, err := os.Stat(path.Join(newDir, name)); err != nil {
+			t.Fatalf("wait file %s not migrated: %v", name, err)
+		}
+	}
+}
+
+func TestMigrateMerge(t *testing.T) {
+	oldDir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(oldDir)
+
+	newDir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(newDir)
+
+	for _, name := range []string{"queuer-W-0-1000-0-0", "queuer-W-0-3000-0-0"} {
+		f, _ := os.Create(path.Join(oldDir, name))
+		f.Close()
+	}
+	for _, name := range []string{"queuer-W-0-500-0-0", "queuer-W-0-2000-0-0"} {
+		f, _ := os.Create(path.Join(newDir, name))
+		f.Close()
+	}
+
+	// The fencing token of the default lock is further along in oldDir, the one of lockA in newDir,
+	// and the one of lockB only exists in oldDir.
+	tokens := []struct {
+		dir, name, token string
+	}{
+		{oldDir, "fencing-token", "7"},
+		{newDir, "fencing-token", "5"},
+		{oldDir, "fencing-token-lockA", "2"},
+		{newDir, "fencing-token-lockA", "9"},
+		{oldDir, "fencing-token-lockB", "3"},
+	}
+	for _, token := range tokens {
+		err = os.WriteFile(path.Join(token.dir, token.name), []byte(token.token), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = Migrate(oldDir, newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derailleur := Derailleur{
+		Dir: newDir,
+	}
+	line, err := derailleur.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"queuer-W-0-500-0-0", "queuer-W-0-1000-0-0", "queuer-W-0-2000-0-0", "queuer-W-0-3000-0-0"}
+	if len(line) != len(expected) {
+		t.Fatalf("expected %d wait files in the merged line, got %d", len(expected), len(line))
+	}
+	for i, name := range expected {
+		if line[i] != path.Join(newDir, name) {
+			t.Fatalf("expected %s at position %d, got %s", name, i, line[i])
+		}
+	}
+
+	for name, token := range map[string]string{"fencing-token": "7", "fencing-token-lockA": "9", "fencing-token-lockB": "3"} {
+		data, err := os.ReadFile(path.Join(newDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != token {
+			t.Fatalf("expected fencing token %s in %s, got %s", token, name, data)
+		}
+		if _, err := os.Stat(path.Join(oldDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s left behind in the old directory", name)
+		}
+	}
+
+	for _, filePath := range line {
+		err = os.Remove(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = derailleur.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derailleur.Token() != 8 {
+		t.Fatalf("expected the fencing token to continue at 8, got %d", derailleur.Token())
+	}
+	err = derailleur.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, _ := os.Create(path.Join(oldDir, "queuer-W-0-4000-0-0"))
+	f.Close()
+	for _, dir := range []string{oldDir, newDir} {
+		f, _ = os.Create(path.Join(dir, "queuer-W-0-2000-0-0"))
+		f.Close()
+	}
+
+	err = Migrate(oldDir, newDir)
+	if err == nil {
+		t.Fatal("expected an error for a wait file that already exists in the new directory")
+	}
+	if _, err := os.Stat(path.Join(oldDir, "queuer-W-0-4000-0-0")); err != nil {
+		t.Fatal("wait file moved despite a conflict")
+	}
+}
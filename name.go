@@ -0,0 +1,313 @@
+package derailleur
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// waitFileName holds the fields that are encoded in the name of a wait file:
+//
+//	<prefix>-[<lock>-][H]<mode>-<priority>-<timestamp>-<sequence>-<suffix>
+//
+// The wait files of versions of the package before modes and priorities were introduced are named
+// <prefix>-<timestamp>-<suffix>. They are still recognized, so that their contenders aren't overlooked
+// during a rolling upgrade, but those versions don't recognize wait files with the current names,
+// so they must not contend for the same lock as the current version at the same time.
+type waitFileName struct {
+	lock      string
+	mode      Mode
+	priority  int
+	timestamp string
+	sequence  string
+	suffix    string
+	// upgrading marks the wait file of a Shared contender that is waiting in Upgrade.
+	// Other contenders treat it like any other Shared wait file.
+	upgrading bool
+	// held marks the wait file of a contender that has acquired the lock, which keeps it ahead of waiting contenders
+	// even if they would sort before it otherwise.
+	held bool
+	// legacy marks a wait file with a name of an older version of the package.
+	legacy bool
+}
+
+// waitFile is a wait file with its parsed name.
+type waitFile struct {
+	path string
+	name waitFileName
+}
+
+// ordering describes how the wait files of a line are sorted.
+type ordering struct {
+	order Order
+	// agingInterval is how long a contender has to wait for its priority to improve by one.
+	// Priorities don't change if it is zero.
+	agingInterval time.Duration
+	// now is the moment at which aged priorities are computed,
+	// which is fixed so that the order is consistent within a single sort.
+	now time.Time
+	// sequenced orders wait files by their sequence numbers before their timestamps.
+	sequenced bool
+}
+
+// sort sorts wait files of the same lock in the order in which their lock contenders are queued.
+// Contenders are ordered by their effective priority first, and then by the order within each priority.
+func (o ordering) sort(waitFiles []waitFile) {
+	sort.SliceStable(waitFiles, func(i, j int) bool {
+		return o.less(waitFiles[i].name, waitFiles[j].name)
+	})
+}
+
+// less reports whether the contender with the wait file a is queued before the one with the wait file b.
+// Contenders that are marked as holding the lock go before all others, whatever their priorities.
+func (o ordering) less(a, b waitFileName) bool {
+	if a.held != b.held {
+		return a.held
+	}
+	if pa, pb := o.effectivePriority(a), o.effectivePriority(b); pa != pb {
+		return pa < pb
+	}
+	if o.order == LIFO {
+		a, b = b, a
+	}
+	if o.sequenced {
+		if c := compareNumbers(a.sequence, b.sequence); c != 0 {
+			return c < 0
+		}
+	}
+	return a.before(b)
+}
+
+// effectivePriority returns the priority of the wait file, improved by one for every aging interval it has waited.
+func (o ordering) effectivePriority(n waitFileName) int64 {
+	priority := int64(n.priority)
+	if o.agingInterval <= 0 {
+		return priority
+	}
+
+	created := n.time()
+	if created.IsZero() || !o.now.After(created) {
+		return priority
+	}
+
+	return priority - int64(o.now.Sub(created)/o.agingInterval)
+}
+
+// String returns the encoding of the mode in the names of wait files.
+func (m Mode) String() string {
+	if m == Shared {
+		return "R"
+	}
+	return "W"
+}
+
+// upgradingMode is the encoding of the mode of a Shared contender that is being upgraded.
+const upgradingMode = "U"
+
+// heldMarker precedes the encoding of the mode of a contender that is marked as holding the lock.
+const heldMarker = "H"
+
+// parseMode parses the encoding of a mode in the name of a wait file.
+func parseMode(s string) (Mode, bool) {
+	switch s {
+	case "R":
+		return Shared, true
+	case "W":
+		return Exclusive, true
+	}
+	return 0, false
+}
+
+// releasingSuffix is appended to the names of wait files that are being released with RenameOnRelease.
+const releasingSuffix = ".releasing"
+
+// parseWaitFileName parses the name of a wait file with the given prefix.
+// It reports false for names of files that aren't such wait files.
+func parseWaitFileName(prefix, name string) (waitFileName, bool) {
+	prefix += "-"
+	if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, releasingSuffix) {
+		return waitFileName{}, false
+	}
+
+	var parsed waitFileName
+
+	fields := strings.Split(strings.TrimPrefix(name, prefix), "-")
+	if len(fields) == 2 && isNumber(fields[0]) && isNumber(fields[1]) {
+		// The contenders of older versions hold the default lock exclusively with the default priority.
+		return waitFileName{timestamp: fields[0], sequence: "0", suffix: fields[1], legacy: true}, true
+	}
+
+	switch len(fields) {
+	case 5:
+	case 6:
+		parsed.lock = fields[0]
+		fields = fields[1:]
+	default:
+		return waitFileName{}, false
+	}
+
+	if len(fields[0]) > len(heldMarker) && strings.HasPrefix(fields[0], heldMarker) {
+		parsed.held = true
+		fields[0] = strings.TrimPrefix(fields[0], heldMarker)
+	}
+	if fields[0] == upgradingMode {
+		parsed.mode = Shared
+		parsed.upgrading = true
+	} else {
+		mode, ok := parseMode(fields[0])
+		if !ok {
+			return waitFileName{}, false
+		}
+		parsed.mode = mode
+	}
+	fields = fields[1:]
+
+	if !isNumber(fields[0]) || !isNumber(fields[1]) || !isNumber(fields[2]) {
+		return waitFileName{}, false
+	}
+
+	priority, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return waitFileName{}, false
+	}
+	parsed.priority = priority
+	parsed.timestamp = fields[1]
+	parsed.sequence = fields[2]
+	parsed.suffix = fields[3]
+
+	return parsed, true
+}
+
+// format returns the name of the wait file with the given prefix, the inverse of parseWaitFileName.
+func (n waitFileName) format(prefix string) string {
+	if n.legacy {
+		return fmt.Sprintf("%s-%s-%s", prefix, n.timestamp, n.suffix)
+	}
+
+	lock := ""
+	if n.lock != "" {
+		lock = n.lock + "-"
+	}
+
+	mode := n.mode.String()
+	if n.upgrading {
+		mode = upgradingMode
+	}
+	if n.held {
+		mode = heldMarker + mode
+	}
+
+	return fmt.Sprintf("%s-%s%s-%d-%s-%s-%s", prefix, lock, mode, n.priority, n.timestamp, n.sequence, n.suffix)
+}
+
+// isNumber reports whether s is a non-empty string of decimal digits.
+func isNumber(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// compareNumbers compares two strings of decimal digits by their numeric values
+// without being limited by the size of integer types.
+func compareNumbers(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// time returns the creation time encoded in the timestamp of the wait file,
+// or the zero time if the timestamp is out of range.
+func (n waitFileName) time() time.Time {
+	nanos, err := strconv.ParseInt(n.timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// before reports whether the wait file n was created before the wait file other.
+// Wait files are ordered by the numeric value of their timestamps. Wait files with the same timestamp
+// are ordered by their sequence numbers, which preserves the order in which one process created them,
+// and finally by the suffix as a tiebreaker.
+func (n waitFileName) before(other waitFileName) bool {
+	if c := compareNumbers(n.timestamp, other.timestamp); c != 0 {
+		return c < 0
+	}
+	if c := compareNumbers(n.sequence, other.sequence); c != 0 {
+		return c < 0
+	}
+	return n.suffix < other.suffix
+}
+
+// validateName checks that a lock name can be encoded in the names of wait files.
+func validateName(name string) error {
+	if strings.ContainsAny(name, `-/\`) {
+		return fmt.Errorf("invalid lock name %q: it must not contain dashes or path separators", name)
+	}
+	return nil
+}
+
+// validatePriority checks that a priority can be encoded in the names of wait files.
+func validatePriority(priority int) error {
+	if priority < 0 {
+		return fmt.Errorf("invalid priority %d: it must not be negative", priority)
+	}
+	return nil
+}
+
+// validatePrefix checks that a prefix can be used for the names of wait files.
+func validatePrefix(prefix string) error {
+	if strings.ContainsAny(prefix, `/\`) {
+		return fmt.Errorf("invalid prefix %q: it must not contain path separators", prefix)
+	}
+	return nil
+}
+
+// newWaitFileName returns the name for a new wait file of the lock contender.
+// The timestamp and the sequence number are zero-padded to a fixed width, so that the names of wait files
+// of the same lock, mode and priority sort lexically in the order in which they were created.
+// The suffix is the PID, which keeps the names of wait files of different processes on a host apart.
+func (co *Derailleur) newWaitFileName() (string, error) {
+	lock := ""
+	if co.Name != "" {
+		lock = co.Name + "-"
+	}
+
+	timestamp, sequence := nextStamp(co.clock())
+	if co.Sequenced {
+		var err error
+		sequence, err = co.nextSequence()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%s-%s%s-%d-%019d-%020d-%d", co.prefix(), lock, co.Mode, co.Priority, timestamp, sequence, os.Getpid()), nil
+}
+
+// createMu serializes naming and creating wait files in the process.
+var createMu sync.Mutex
+
+var (
+	// stampMu guards sequence, so that the sequence numbers of a process increase along with its timestamps.
+	stampMu  sync.Mutex
+	sequence uint64
+)
+
+// nextStamp returns the timestamp from clock and the sequence number for the name of a new wait file.
+// The sequence number increases with every wait file that the process creates.
+func nextStamp(clock Clock) (int64, uint64) {
+	stampMu.Lock()
+	defer stampMu.Unlock()
+
+	sequence++
+	return clock.Now().UnixNano(), sequence
+}
@@ -0,0 +1,850 @@
+package derailleur
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNamedLocks(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var holders []*Derailleur
+	for _, name := range []string{"", "lockA", "lockB"} {
+		holder := &Derailleur{
+			Dir:  dir,
+			Name: name,
+		}
+		file, err := holder.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		holders = append(holders, holder)
+	}
+
+	// Every lock has its own line, so all of the contenders hold their locks.
+	for _, holder := range holders {
+		ctx, cancelFn := context.WithTimeout(context.Background(), time.Second)
+		err := holder.WaitInLine(ctx)
+		cancelFn()
+		if err != nil {
+			t.Fatalf("contender for lock %q: %v", holder.Name, err)
+		}
+	}
+
+	contender := Derailleur{
+		Dir:  dir,
+		Name: "lockA",
+	}
+	file, err := contender.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	position, err := contender.Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 1 {
+		t.Fatalf("expected position 1, got %d", position)
+	}
+
+	err = contender.CutInLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 3 {
+		t.Fatal("CutInLine removed wait files of other locks")
+	}
+}
+
+func TestInvalidName(t *testing.T) {
+	derailleur := Derailleur{
+		Dir:  os.TempDir(),
+		Name: "lock-A",
+	}
+
+	_, err := derailleur.CreateWaitFile()
+	if err == nil {
+		t.Fatal("expected an error for a name with a dash")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tool := Derailleur{
+		Dir:    dir,
+		Prefix: "deploy-queue",
+	}
+	file, err := tool.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if !strings.HasPrefix(path.Base(file.Name()), "deploy-queue-") {
+		t.Fatalf("expected the wait file to have the prefix, got %s", file.Name())
+	}
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err = derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// Each prefix has its own line.
+	for _, co := range []*Derailleur{&tool, &derailleur} {
+		line, err := co.line()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(line) != 1 || line[0] != co.FilePath {
+			t.Fatalf("expected only %s in line, got %v", co.FilePath, line)
+		}
+	}
+
+	invalid := Derailleur{
+		Dir:    dir,
+		Prefix: "deploy/queue",
+	}
+	_, err = invalid.CreateWaitFile()
+	if err == nil {
+		t.Fatal("expected an error for a prefix with a path separator")
+	}
+}
+
+func TestParseWaitFileName(t *testing.T) {
+	tests := []struct {
+		name   string
+		parsed waitFileName
+		ok     bool
+	}{
+		{"queuer-W-0-123-7-456", waitFileName{timestamp: "123", sequence: "7", suffix: "456"}, true},
+		{"queuer-W-2-123-7-456", waitFileName{priority: 2, timestamp: "123", sequence: "7", suffix: "456"}, true},
+		{"queuer-R-0-123-7-456", waitFileName{mode: Shared, timestamp: "123", sequence: "7", suffix: "456"}, true},
+		{"queuer-lockA-W-0-123-7-456", waitFileName{lock: "lockA", timestamp: "123", sequence: "7", suffix: "456"}, true},
+		{"queuer-U-0-123-7-456", waitFileName{mode: Shared, timestamp: "123", sequence: "7", suffix: "456", upgrading: true}, true},
+		{"queuer-HW-3-123-7-456", waitFileName{priority: 3, timestamp: "123", sequence: "7", suffix: "456", held: true}, true},
+		{"queuer-lockA-HU-0-123-7-456", waitFileName{lock: "lockA", mode: Shared, timestamp: "123", sequence: "7", suffix: "456", upgrading: true, held: true}, true},
+		{"queuer-1700000000000000000-123456", waitFileName{timestamp: "1700000000000000000", sequence: "0", suffix: "123456", legacy: true}, true},
+		{"queuer-W-0-123-456", waitFileName{}, false},
+		{"queuer-0-123-7-456", waitFileName{}, false},
+		{"queuer-X-0-123-7-456", waitFileName{}, false},
+		{"queuer-H-0-123-7-456", waitFileName{}, false},
+		{"queuer-HX-0-123-7-456", waitFileName{}, false},
+		{"queuer-123-x", waitFileName{}, false},
+		{"queuer-lockA-W-0-123-456", waitFileName{}, false},
+		{"queuer-lockA-W-x-123-7-456", waitFileName{}, false},
+		{"queuer-lockA-W-0-123-x-456", waitFileName{}, false},
+		{"queuer-a-b-W-0-123-7-456", waitFileName{}, false},
+		{"queuer-W-0-123-7-456.releasing", waitFileName{}, false},
+		{".DS_Store", waitFileName{}, false},
+	}
+
+	for _, test := range tests {
+		parsed, ok := parseWaitFileName(defaultPrefix, test.name)
+		if ok != test.ok || parsed != test.parsed {
+			t.Errorf("parseWaitFileName(%q) = %+v, %t; expected %+v, %t", test.name, parsed, ok, test.parsed, test.ok)
+		}
+		if ok && parsed.format(defaultPrefix) != test.name {
+			t.Errorf("format(%+v) = %q; expected %q", parsed, parsed.format(defaultPrefix), test.name)
+		}
+	}
+}
+
+func TestLineNumericOrder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Lexically sorted, these would be in the reverse order.
+	names := []string{"queuer-W-0-999-0-1", "queuer-W-0-1000-0-0", "queuer-W-0-1000-0-1", "queuer-W-0-1000-2-0", "queuer-W-0-1000-10-0", "queuer-W-0-10000-0-0"}
+	for _, name := range names {
+		f, _ := os.Create(path.Join(dir, name))
+		f.Close()
+	}
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	line, err := derailleur.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(line) != len(names) {
+		t.Fatalf("expected %d wait files, got %d", len(names), len(line))
+	}
+	for i, name := range names {
+		if line[i] != path.Join(dir, name) {
+			t.Fatalf("expected %s at position %d, got %s", name, i, line[i])
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var filePaths []string
+	for _, priority := range []int{1, 0, 1, 0} {
+		derailleur := Derailleur{
+			Dir:      dir,
+			Priority: priority,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		filePaths = append(filePaths, file.Name())
+	}
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	line, err := derailleur.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// High priority contenders go first, each priority in the order of arrival.
+	expected := []string{filePaths[1], filePaths[3], filePaths[0], filePaths[2]}
+	for i, filePath := range expected {
+		if line[i] != filePath {
+			t.Fatalf("expected %s at position %d, got %s", filePath, i, line[i])
+		}
+	}
+
+	invalid := Derailleur{
+		Dir:      dir,
+		Priority: -1,
+	}
+	_, err = invalid.CreateWaitFile()
+	if err == nil {
+		t.Fatal("expected an error for a negative priority")
+	}
+}
+
+func TestPriorityHolder(t *testing.T) {
+	for _, mode := range []Mode{Exclusive, Shared} {
+		dir, err := os.MkdirTemp("", "juju-task-testing-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		holder := Derailleur{
+			Dir:      dir,
+			Priority: 5,
+			Mode:     mode,
+		}
+		err = holder.Lock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		newcomer := Derailleur{
+			Dir: dir,
+		}
+		done := make(chan error)
+
+		go func() {
+			done <- newcomer.Lock(context.Background())
+		}()
+
+		select {
+		case <-done:
+			t.Fatalf("mode %s: higher priority contender acquired a lock that is already held", mode)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		isFirst, err := holder.AmIFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isFirst {
+			t.Fatalf("mode %s: holder overtaken by a higher priority contender", mode)
+		}
+
+		eager := Derailleur{
+			Dir: dir,
+		}
+		locked, err := eager.TryLock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked {
+			t.Fatalf("mode %s: higher priority contender locked a lock that is already held", mode)
+		}
+
+		err = holder.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatalf("mode %s: contender not waking up", mode)
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = newcomer.Release()
+	}
+}
+
+// markingFS is an FS that calls beforeMark once, right before a wait file is first renamed to be marked as held.
+type markingFS struct {
+	FS
+	once       sync.Once
+	beforeMark func()
+}
+
+func (f *markingFS) Rename(oldpath, newpath string) error {
+	if name, ok := parseWaitFileName(defaultPrefix, path.Base(newpath)); ok && name.held {
+		f.once.Do(f.beforeMark)
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+func TestPriorityMarkRace(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A higher priority contender that doesn't mark its wait file joins and acquires the lock
+	// while the low priority contender that was first is about to mark its own.
+	eager := Derailleur{
+		Dir: dir,
+	}
+	eagerErr := make(chan error, 1)
+	marking := &markingFS{FS: osFS{}, beforeMark: func() {
+		eagerErr <- eager.Lock(context.Background())
+	}}
+	low := Derailleur{
+		Dir:      dir,
+		FS:       marking,
+		Priority: 5,
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- low.Lock(context.Background())
+	}()
+
+	select {
+	case err := <-eagerErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the higher priority contender didn't acquire the lock")
+	}
+
+	select {
+	case <-done:
+		t.Fatal("both contenders acquired the lock")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = eager.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the low priority contender didn't acquire the lock after the other one released it")
+	}
+	err = low.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPriorityMutualExclusion(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every contender sends at most one error, so none of them blocks on a full channel.
+	const contenders = 8
+	var holding int32
+	var wg sync.WaitGroup
+	errs := make(chan error, contenders)
+
+	for i := 0; i < contenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				derailleur := Derailleur{
+					Dir:      dir,
+					Priority: (i + j) % 3,
+				}
+				err := derailleur.Lock(context.Background())
+				if err != nil {
+					errs <- err
+					return
+				}
+				overlapped := atomic.AddInt32(&holding, 1) != 1
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&holding, -1)
+				err = derailleur.Release()
+				if overlapped {
+					errs <- fmt.Errorf("lock held by more than one contender")
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestAging(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A low priority contender that has been waiting for a while.
+	clock := newFakeClock()
+	low := Derailleur{
+		Dir:      dir,
+		Priority: 3,
+		Clock:    clock,
+	}
+	f, err := low.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	old := low.FilePath
+
+	clock.Advance(time.Hour)
+
+	high := Derailleur{
+		Dir:           dir,
+		AgingInterval: 10 * time.Minute,
+		Clock:         clock,
+	}
+	file, err := high.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	line, err := high.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line[0] != old {
+		t.Fatal("long waiting low priority contender didn't overtake a new high priority one")
+	}
+
+	// Without aging, the high priority contender goes first.
+	high.AgingInterval = 0
+
+	line, err = high.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line[0] != high.FilePath {
+		t.Fatal("high priority contender isn't first without aging")
+	}
+}
+
+func TestAgingHolder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+
+	waiter := Derailleur{
+		Dir:           dir,
+		Priority:      1,
+		AgingInterval: time.Minute,
+		Clock:         clock,
+	}
+	file, err := waiter.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	clock.Advance(30 * time.Second)
+
+	holder := Derailleur{
+		Dir:           dir,
+		AgingInterval: time.Minute,
+		Clock:         clock,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// By now the waiter's priority has improved to that of the holder, and it has been waiting for longer.
+	clock.Advance(30 * time.Second)
+
+	isFirst, err := holder.AmIFirst()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFirst {
+		t.Fatal("holder overtaken by an aged contender")
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- waiter.WaitInLine(context.Background())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("aged contender acquired a lock that is already held")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = holder.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("aged contender not waking up")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLineCreationOrder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	// Created in a tight loop, many of these get the same timestamp on systems with a coarse clock.
+	n := 2000
+	created := make([]string, n)
+	for i := range created {
+		file, err := derailleur.createWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		created[i] = file.Name()
+	}
+
+	line, err := derailleur.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(line) != n {
+		t.Fatalf("expected %d wait files, got %d", n, len(line))
+	}
+	for i := range line {
+		if line[i] != created[i] {
+			t.Fatalf("expected wait file %d to be %s, got %s", i, created[i], line[i])
+		}
+	}
+
+	// The names sort lexically in the same order.
+	if !sort.StringsAreSorted(created) {
+		t.Fatal("names of wait files don't sort lexically in creation order")
+	}
+}
+
+func TestAcquisitionOrder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 20
+	contenders := make([]*Derailleur, n)
+	for i := range contenders {
+		contenders[i] = &Derailleur{
+			Dir: dir,
+		}
+		file, err := contenders[i].CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	acquired := make(chan int, n)
+	errs := make(chan error, n)
+
+	// Start waiting in reverse, so that the order of acquisition can't come from the order of the goroutines.
+	for i := n - 1; i >= 0; i-- {
+		go func(i int) {
+			err := contenders[i].WaitInLine(context.Background())
+			if err == nil {
+				acquired <- i
+				err = contenders[i].Release()
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	for want := 0; want < n; want++ {
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		case got := <-acquired:
+			if got != want {
+				t.Fatalf("expected contender %d to acquire the lock next, got %d", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Lock not passed on.")
+		}
+	}
+}
+
+func TestConcurrentAcquisitionOrder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 20
+	contenders := make([]*Derailleur, n)
+	sequences := make([]uint64, n)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, n)
+
+	for i := range contenders {
+		contenders[i] = &Derailleur{
+			Dir: dir,
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+
+			file, err := contenders[i].CreateWaitFile()
+			if err != nil {
+				errs <- err
+				return
+			}
+			file.Close()
+
+			name, _ := parseWaitFileName(defaultPrefix, path.Base(contenders[i].FilePath))
+			sequences[i], err = strconv.ParseUint(name.sequence, 10, 64)
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+
+	// The order in which the wait files were created.
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return sequences[order[a]] < sequences[order[b]]
+	})
+
+	acquired := make(chan int, n)
+	for i := range contenders {
+		go func(i int) {
+			err := contenders[i].WaitInLine(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			acquired <- i
+		}(i)
+	}
+
+	for _, want := range order {
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		case got := <-acquired:
+			if got != want {
+				t.Fatalf("expected contender %d to acquire the lock next, got %d", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Lock not passed on.")
+		}
+
+		// No one else may acquire the lock while it is held.
+		select {
+		case got := <-acquired:
+			t.Fatalf("contender %d acquired the lock while %d holds it", got, want)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		err := contenders[want].Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSequenced(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The clock was set back by an hour after this contender joined the line.
+	waiting := path.Join(dir, fmt.Sprintf("queuer-W-0-%d-1-0", time.Now().Add(time.Hour).UnixNano()))
+	f, _ := os.Create(waiting)
+	f.Close()
+
+	derailleur := Derailleur{
+		Dir:       dir,
+		Sequenced: true,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	line, err := derailleur.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(line) != 2 || line[0] != waiting || line[1] != file.Name() {
+		t.Fatalf("expected the new contender to be behind the waiting one, got %v", line)
+	}
+
+	// Ordered by the clock, the new contender would have gotten ahead.
+	derailleur.Sequenced = false
+	line, err = derailleur.line()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line[0] != file.Name() {
+		t.Fatalf("expected the new contender to be first by the clock, got %v", line)
+	}
+}
+
+func FuzzOrdering(f *testing.F) {
+	f.Add("queuer-W-0-123-7-456", "queuer-R-2-123-8-1", "queuer-W-0-0123-7-456")
+	f.Add("queuer-lockA-W-0-1-0-0", "queuer-W-99999999999999999999-1-0-0", "queuer-W-0-99999999999999999999-0-0")
+	f.Add(".DS_Store", "queuer-", "queuer-W--0-0-0")
+
+	orderings := []ordering{
+		{order: FIFO},
+		{order: LIFO},
+		{order: FIFO, agingInterval: time.Second, now: time.Unix(0, 5000000000)},
+		{order: FIFO, sequenced: true},
+	}
+
+	f.Fuzz(func(t *testing.T, a, b, c string) {
+		var names []waitFileName
+		for _, name := range []string{a, b, c} {
+			parsed, ok := parseWaitFileName(defaultPrefix, name)
+			if ok {
+				names = append(names, parsed)
+			}
+		}
+
+		// The order has to be a strict weak order for sorting to be consistent.
+		for _, o := range orderings {
+			for _, x := range names {
+				if o.less(x, x) {
+					t.Fatalf("%+v is less than itself", x)
+				}
+				for _, y := range names {
+					if o.less(x, y) && o.less(y, x) {
+						t.Fatalf("%+v and %+v are both less than each other", x, y)
+					}
+					for _, z := range names {
+						if o.less(x, y) && o.less(y, z) && !o.less(x, z) {
+							t.Fatalf("%+v < %+v < %+v, but not %+v < %+v", x, y, z, x, z)
+						}
+						incomparable := func(p, q waitFileName) bool { return !o.less(p, q) && !o.less(q, p) }
+						if incomparable(x, y) && incomparable(y, z) && !incomparable(x, z) {
+							t.Fatalf("%+v ~ %+v ~ %+v, but not %+v ~ %+v", x, y, z, x, z)
+						}
+					}
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package derailleur
+
+import "os"
+
+// processAlive reports whether a process with the given PID is running on this host.
+func processAlive(pid int) bool {
+	// On Windows FindProcess opens a handle to the process, which fails if it doesn't exist.
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = process.Release()
+
+	return true
+}
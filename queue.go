@@ -0,0 +1,275 @@
+package derailleur
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// QueueEntry describes a lock contender waiting in line or holding the lock.
+type QueueEntry struct {
+	FilePath string
+	// Lock is the name of the lock that the contender is waiting for.
+	Lock string
+	// CreatedAt is the creation time encoded in the name of the wait file.
+	CreatedAt time.Time
+	// PID and Hostname identify the process of the lock contender.
+	// They are empty if the wait file doesn't contain holder information.
+	PID      int
+	Hostname string
+}
+
+// Stats is a snapshot of the line of a lock.
+type Stats struct {
+	// QueueDepth is the number of lock contenders in line, including the holders.
+	QueueDepth int
+	// MyPosition is the position of the lock contender in line, or -1 if it isn't in line.
+	MyPosition int
+	// OldestAge is how long the contender at the head of the line has been in line.
+	OldestAge time.Duration
+	// HolderPID is the PID of the process of the contender at the head of the line.
+	// It is 0 if the line is empty or the wait file doesn't contain holder information.
+	HolderPID int
+}
+
+// Stats returns a snapshot of the line, taken from a single listing of Dir.
+func (co *Derailleur) Stats() (Stats, error) {
+	line, err := co.waitFiles()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{
+		QueueDepth: len(line),
+		MyPosition: -1,
+	}
+
+	own := co.filePath()
+	for i, f := range line {
+		if f.path == own {
+			stats.MyPosition = i
+		}
+	}
+
+	if len(line) > 0 {
+		head := newQueueEntry(line[0], co.fs().ReadFile)
+		if !head.CreatedAt.IsZero() {
+			stats.OldestAge = co.clock().Now().Sub(head.CreatedAt)
+		}
+		stats.HolderPID = head.PID
+	}
+
+	return stats, nil
+}
+
+// List returns the lock contenders in the order in which they are queued.
+func (co *Derailleur) List() ([]QueueEntry, error) {
+	line, err := co.waitFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]QueueEntry, 0, len(line))
+	for _, f := range line {
+		entries = append(entries, newQueueEntry(f, co.fs().ReadFile))
+	}
+
+	return entries, nil
+}
+
+// QueueSnapshot is the full line of a lock at a moment, e.g. for audit logs.
+type QueueSnapshot struct {
+	// Timestamp is when the line was listed.
+	Timestamp time.Time       `json:"timestamp"`
+	Entries   []SnapshotEntry `json:"entries"`
+}
+
+// SnapshotEntry describes a lock contender in a QueueSnapshot.
+type SnapshotEntry struct {
+	// Position is the position of the contender in line, starting at 0 for the head of the line.
+	Position int    `json:"position"`
+	FilePath string `json:"path"`
+	// Lock, Mode and Priority are parsed from the name of the wait file.
+	// Mode is "W" for Exclusive and "R" for Shared contenders.
+	Lock     string `json:"lock,omitempty"`
+	Mode     string `json:"mode"`
+	Priority int    `json:"priority"`
+	// CreatedAt is the creation time encoded in the name of the wait file, and Age is how long before Timestamp
+	// that was. Both are zero if the timestamp is out of range.
+	CreatedAt time.Time     `json:"created_at"`
+	Age       time.Duration `json:"age"`
+	// PID, Hostname and Payload are read from the wait file.
+	// They are empty if the wait file doesn't contain holder information.
+	PID      int    `json:"pid,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Payload  []byte `json:"payload,omitempty"`
+}
+
+// Snapshot returns the lock contenders in the order in which they are queued, with everything that is known
+// about each of them. Unlike Stats, which only aggregates the line, it describes every entry,
+// and unlike List, all entries are relative to the same Timestamp. It is taken from a single listing of Dir.
+func (co *Derailleur) Snapshot() (QueueSnapshot, error) {
+	line, err := co.waitFiles()
+	if err != nil {
+		return QueueSnapshot{}, err
+	}
+
+	snapshot := QueueSnapshot{
+		Timestamp: co.clock().Now(),
+		Entries:   make([]SnapshotEntry, 0, len(line)),
+	}
+	for i, f := range line {
+		entry := SnapshotEntry{
+			Position:  i,
+			FilePath:  f.path,
+			Lock:      f.name.lock,
+			Mode:      f.name.mode.String(),
+			Priority:  f.name.priority,
+			CreatedAt: f.name.time(),
+		}
+		if !entry.CreatedAt.IsZero() {
+			entry.Age = snapshot.Timestamp.Sub(entry.CreatedAt)
+		}
+
+		data, err := co.fs().ReadFile(f.path)
+		if err == nil {
+			info, err := parseHolderInfo(data)
+			if err == nil {
+				entry.PID = info.PID
+				entry.Hostname = info.Hostname
+				entry.Payload = info.Payload
+			}
+		}
+
+		snapshot.Entries = append(snapshot.Entries, entry)
+	}
+
+	return snapshot, nil
+}
+
+// PeekNext returns the lock contender that acquires the lock next once a current holder releases it,
+// i.e. the second in line for an exclusive lock. It reports false if no contender is waiting behind the holders.
+func (co *Derailleur) PeekNext() (QueueEntry, bool, error) {
+	line, err := co.waitFiles()
+	if err != nil {
+		return QueueEntry{}, false, err
+	}
+
+	if len(line) <= co.limit() {
+		return QueueEntry{}, false, nil
+	}
+
+	return newQueueEntry(line[co.limit()], co.fs().ReadFile), true, nil
+}
+
+// ClearQueue removes the wait files of all lock contenders of the lock, including the holders,
+// and returns how many were removed. Files in Dir that aren't wait files of the lock are left alone.
+// This forcibly breaks the lock for everyone: waiting contenders get ErrLockLost,
+// and holders aren't notified at all, so it is meant for resetting a deployment.
+// Wait files that are removed by someone else in the meantime are not an error, but aren't counted.
+func (co *Derailleur) ClearQueue() (int, error) {
+	line, err := co.line()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, filePath := range line {
+		ok, err := co.removeWaitFileIfPresent(filePath)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// WaitUntilEmpty blocks until no lock contenders of the lock remain in line, e.g. so that a controller
+// can wait for all workers to finish before tearing down shared resources. Files in Dir that aren't
+// wait files of the lock are ignored. It returns early with the context's error if ctx is cancelled.
+func (co *Derailleur) WaitUntilEmpty(ctx context.Context) error {
+	for {
+		// Set up the watcher before checking, so that no removal is missed in between.
+		changed := make(chan error, 1)
+		watcher := watchDir(co.Dir, changed)
+
+		line, err := co.line()
+		if err != nil || len(line) == 0 {
+			closeWatcher(watcher)
+			return err
+		}
+
+		select {
+		case err = <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		closeWatcher(watcher)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Inspect returns the lock contenders of all locks in dir without modifying anything, so it can be used
+// by monitoring processes that have read-only access to the directory.
+// The entries are grouped by lock, and the contenders of each lock are in the order in which they are queued.
+// Only wait files with the default Prefix are included.
+func Inspect(fsys fs.FS, dir string) ([]QueueEntry, error) {
+	files, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var waitFiles []waitFile
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name, ok := parseWaitFileName(defaultPrefix, f.Name())
+		if !ok {
+			continue
+		}
+		waitFiles = append(waitFiles, waitFile{path.Join(dir, f.Name()), name})
+	}
+
+	ordering{}.sort(waitFiles)
+	sort.SliceStable(waitFiles, func(i, j int) bool {
+		return waitFiles[i].name.lock < waitFiles[j].name.lock
+	})
+
+	entries := make([]QueueEntry, 0, len(waitFiles))
+	for _, f := range waitFiles {
+		entries = append(entries, newQueueEntry(f, func(name string) ([]byte, error) {
+			return fs.ReadFile(fsys, name)
+		}))
+	}
+
+	return entries, nil
+}
+
+// newQueueEntry describes the lock contender with the given wait file, reading its contents with readFile.
+func newQueueEntry(f waitFile, readFile func(name string) ([]byte, error)) QueueEntry {
+	entry := QueueEntry{
+		FilePath:  f.path,
+		Lock:      f.name.lock,
+		CreatedAt: f.name.time(),
+	}
+
+	data, err := readFile(f.path)
+	if err == nil {
+		info, err := parseHolderInfo(data)
+		if err == nil {
+			entry.PID = info.PID
+			entry.Hostname = info.Hostname
+		}
+	}
+
+	return entry
+}
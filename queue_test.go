@@ -0,0 +1,426 @@
+package derailleur
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unrelated, _ := os.Create(path.Join(dir, ".DS_Store"))
+	unrelated.Close()
+
+	before := time.Now()
+
+	n := 3
+	var filePaths []string
+	for i := 0; i < n; i++ {
+		derailleur := Derailleur{
+			Dir: dir,
+		}
+		file, err := derailleur.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		filePaths = append(filePaths, file.Name())
+	}
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	entries, err := derailleur.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != n {
+		t.Fatalf("expected %d entries, got %d", n, len(entries))
+	}
+
+	hostname, _ := os.Hostname()
+
+	for i, entry := range entries {
+		if entry.FilePath != filePaths[i] {
+			t.Fatalf("expected %s at position %d, got %s", filePaths[i], i, entry.FilePath)
+		}
+		if entry.CreatedAt.Before(before) || entry.CreatedAt.After(time.Now()) {
+			t.Fatalf("unexpected creation time %s", entry.CreatedAt)
+		}
+		if entry.PID != os.Getpid() || entry.Hostname != hostname {
+			t.Fatalf("unexpected holder %d@%s", entry.PID, entry.Hostname)
+		}
+	}
+}
+
+func TestPeekNext(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unrelated, _ := os.Create(path.Join(dir, ".DS_Store"))
+	unrelated.Close()
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	var filePaths []string
+	for i := 0; i < 3; i++ {
+		_, ok, err := derailleur.PeekNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (i >= 2) {
+			t.Fatalf("expected a next contender with %d in line to be %t", i, !ok)
+		}
+
+		file, err := derailleur.createWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		filePaths = append(filePaths, file.Name())
+	}
+
+	next, ok, err := derailleur.PeekNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || next.FilePath != filePaths[1] {
+		t.Fatalf("expected %s to be next, got %s", filePaths[1], next.FilePath)
+	}
+}
+
+func TestClearQueue(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unrelated, _ := os.Create(path.Join(dir, ".DS_Store"))
+	unrelated.Close()
+
+	other := Derailleur{
+		Dir:  dir,
+		Name: "other",
+	}
+	file, err := other.createWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	n := 3
+	for i := 0; i < n; i++ {
+		file, err := derailleur.createWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	removed, err := derailleur.ClearQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != n {
+		t.Fatalf("expected %d wait files to be removed, got %d", n, removed)
+	}
+
+	// The unrelated file and the wait file of the other lock are left alone.
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files to be left, got %d", len(files))
+	}
+}
+
+func TestClearQueueRelease(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	releasing := &releasingFS{FS: osFS{}, failures: 1}
+	derailleur := Derailleur{
+		Dir:             dir,
+		FS:              releasing,
+		RenameOnRelease: true,
+		Retry: RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     time.Millisecond,
+		},
+	}
+	var filePaths []string
+	for i := 0; i < 3; i++ {
+		file, err := derailleur.createWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		filePaths = append(filePaths, file.Name())
+	}
+
+	removed, err := derailleur.ClearQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != len(filePaths) {
+		t.Fatalf("expected %d wait files to be removed, got %d", len(filePaths), removed)
+	}
+	checkReleased(t, releasing, dir, filePaths)
+}
+
+func TestStats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	stats, err := derailleur.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{MyPosition: -1}) {
+		t.Fatalf("unexpected stats for an empty line %+v", stats)
+	}
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	file, err := holder.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	file, err = derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	stats, err = derailleur.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.QueueDepth != 2 || stats.MyPosition != 1 || stats.HolderPID != os.Getpid() {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.OldestAge < 100*time.Millisecond || stats.OldestAge > time.Minute {
+		t.Fatalf("unexpected age of the head %s", stats.OldestAge)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+
+	holder := Derailleur{
+		Dir:     dir,
+		Clock:   clock,
+		Payload: []byte("job 42"),
+	}
+	file, err := holder.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	clock.Advance(time.Minute)
+
+	waiter := Derailleur{
+		Dir:      dir,
+		Clock:    clock,
+		Mode:     Shared,
+		Priority: 3,
+	}
+	file, err = waiter.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	clock.Advance(time.Second)
+
+	snapshot, err := holder.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !snapshot.Timestamp.Equal(clock.Now()) {
+		t.Fatalf("expected the snapshot to be taken at %s, got %s", clock.Now(), snapshot.Timestamp)
+	}
+	if len(snapshot.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(snapshot.Entries))
+	}
+
+	hostname, _ := os.Hostname()
+
+	head, next := snapshot.Entries[0], snapshot.Entries[1]
+	if head.Position != 0 || head.FilePath != holder.filePath() || head.Mode != "W" || head.Priority != 0 {
+		t.Fatalf("unexpected head %+v", head)
+	}
+	if head.Age != time.Minute+time.Second || string(head.Payload) != "job 42" {
+		t.Fatalf("unexpected head %+v", head)
+	}
+	if head.PID != os.Getpid() || head.Hostname != hostname {
+		t.Fatalf("unexpected holder %d@%s", head.PID, head.Hostname)
+	}
+	if next.Position != 1 || next.FilePath != waiter.filePath() || next.Mode != "R" || next.Priority != 3 {
+		t.Fatalf("unexpected second entry %+v", next)
+	}
+	if next.Age != time.Second || next.Payload != nil {
+		t.Fatalf("unexpected second entry %+v", next)
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded QueueSnapshot
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Timestamp.Equal(snapshot.Timestamp) || len(decoded.Entries) != 2 ||
+		decoded.Entries[0].FilePath != head.FilePath || decoded.Entries[0].Age != head.Age ||
+		string(decoded.Entries[0].Payload) != "job 42" {
+		t.Fatalf("snapshot didn't survive JSON encoding: %s", data)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{".DS_Store", "queuer-lockB-W-0-1-0-0", "queuer-W-0-1000-0-0", "queuer-lockA-W-0-5-0-0", "queuer-W-0-999-0-0"}
+	for _, name := range names {
+		f, _ := os.Create(path.Join(dir, name))
+		f.Close()
+	}
+
+	entries, err := Inspect(os.DirFS(dir), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"queuer-W-0-999-0-0", "queuer-W-0-1000-0-0", "queuer-lockA-W-0-5-0-0", "queuer-lockB-W-0-1-0-0"}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for i, name := range expected {
+		if entries[i].FilePath != name {
+			t.Fatalf("expected %s at position %d, got %s", name, i, entries[i].FilePath)
+		}
+	}
+	if entries[2].Lock != "lockA" {
+		t.Fatalf("expected lock lockA, got %q", entries[2].Lock)
+	}
+}
+
+func TestWaitUntilEmpty(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unrelated, _ := os.Create(path.Join(dir, "unrelated"))
+	unrelated.Close()
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	err = derailleur.WaitUntilEmpty(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var workers []string
+	for i := 0; i < 3; i++ {
+		worker := Derailleur{
+			Dir: dir,
+		}
+		file, err := worker.CreateWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		workers = append(workers, file.Name())
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- derailleur.WaitUntilEmpty(context.Background())
+	}()
+
+	for _, worker := range workers {
+		select {
+		case <-done:
+			t.Fatal("Returned while contenders remain in line.")
+		case <-time.After(100 * time.Millisecond):
+		}
+		_ = os.Remove(worker)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Didn't return after the line drained.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	worker := Derailleur{
+		Dir: dir,
+	}
+	file, err := worker.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = derailleur.WaitUntilEmpty(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package derailleur
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy describes how filesystem operations are retried when they fail with transient errors,
+// as they occasionally do on network filesystems.
+type RetryPolicy struct {
+	// MaxAttempts is how often an operation is attempted in total. Operations aren't retried if it is less than 2.
+	MaxAttempts int
+	// Backoff is how long to wait before the first retry. The wait doubles with every further retry.
+	Backoff time.Duration
+	// Retryable reports whether an error is transient. By default, EAGAIN, EINTR, EBUSY and ESTALE are.
+	Retryable func(err error) bool
+}
+
+// retryable reports whether err is transient according to the policy.
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ESTALE)
+}
+
+// retry runs op until it succeeds, fails with an error that isn't transient, or runs out of attempts,
+// and returns the last error.
+func (co *Derailleur) retry(op func() error) error {
+	backoff := co.Retry.Backoff
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= co.Retry.MaxAttempts || !co.Retry.retryable(err) {
+			return err
+		}
+
+		co.logger().Infof("Retrying after transient error: %v", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,91 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyFS is an FS on which listing directories fails with err a number of times before it works.
+type flakyFS struct {
+	FS
+	mu       sync.Mutex
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	f.calls++
+	if f.failures > 0 {
+		f.failures--
+		f.mu.Unlock()
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: f.err}
+	}
+	f.mu.Unlock()
+
+	return f.FS.ReadDir(name)
+}
+
+func TestRetry(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	flaky := &flakyFS{FS: osFS{}}
+	derailleur := Derailleur{
+		Dir: dir,
+		FS:  flaky,
+		Retry: RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     time.Millisecond,
+		},
+	}
+
+	// Transient errors are retried.
+	flaky.failures, flaky.err = 2, syscall.ESTALE
+	err = derailleur.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = derailleur.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// They surface once the attempts are exhausted.
+	flaky.failures, flaky.err = 3, syscall.ESTALE
+	err = derailleur.Lock(context.Background())
+	if !errors.Is(err, syscall.ESTALE) {
+		t.Fatalf("expected ESTALE, got %v", err)
+	}
+
+	// Other errors aren't retried.
+	flaky.failures, flaky.err, flaky.calls = 3, syscall.EACCES, 0
+	err = derailleur.Lock(context.Background())
+	if !errors.Is(err, syscall.EACCES) || flaky.calls != 1 {
+		t.Fatalf("expected EACCES after a single attempt, got %v after %d", err, flaky.calls)
+	}
+
+	// Which errors are transient can be customized.
+	derailleur.Retry.Retryable = func(err error) bool {
+		return errors.Is(err, syscall.EACCES)
+	}
+	flaky.failures, flaky.err = 2, syscall.EACCES
+	err = derailleur.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = derailleur.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,146 @@
+package derailleur
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sequenceFilePrefix is the prefix of the names of the files that claim the sequence numbers of a Sequenced lock.
+// The names end with the claimed number, after the name of the lock for locks other than the default one.
+const sequenceFilePrefix = "sequence"
+
+// sequenceFilePath returns the path of the file that claims the sequence number for the lock.
+func (co *Derailleur) sequenceFilePath(sequence uint64) string {
+	return path.Join(co.Dir, co.sequenceFileNamePrefix()+strconv.FormatUint(sequence, 10))
+}
+
+// sequenceFileNamePrefix returns the part of the names of the files that claim sequence numbers for the lock
+// that comes before the number.
+func (co *Derailleur) sequenceFileNamePrefix() string {
+	if co.Name != "" {
+		return sequenceFilePrefix + "-" + co.Name + "-"
+	}
+	return sequenceFilePrefix + "-"
+}
+
+// nextSequence claims the sequence number for a new wait file of a Sequenced lock, which is higher than
+// every number that was claimed for the lock before and every one in line.
+//
+// A number is claimed by creating a file for it exclusively, so contenders that join at the same moment,
+// even from different hosts, can't claim the same one. Once a number is claimed the files of lower numbers
+// are removed, so only the file of the highest number is kept. A contender that listed Dir before
+// such a removal may claim a removed number once more, which is why it lists Dir again after claiming
+// and tries again if a higher number was claimed in the meantime.
+func (co *Derailleur) nextSequence() (uint64, error) {
+	for {
+		claimed, highest, err := co.sequences()
+		if err != nil {
+			return 0, err
+		}
+		for _, sequence := range claimed {
+			if sequence > highest {
+				highest = sequence
+			}
+		}
+
+		sequence := highest + 1
+		filePath := co.sequenceFilePath(sequence)
+		var file File
+		err = co.retry(func() error {
+			var err error
+			file, err = co.fs().CreateExclusive(filePath)
+			return err
+		})
+		if errors.Is(err, fs.ErrExist) {
+			// Another contender claimed the number first.
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = file.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		claimed, _, err = co.sequences()
+		if err != nil {
+			return 0, err
+		}
+
+		var superseded bool
+		for _, other := range claimed {
+			if other > sequence {
+				superseded = true
+			}
+		}
+		if superseded {
+			// The number was claimed before, and its file was removed after a higher one was claimed.
+			err = co.fs().Remove(filePath)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return 0, err
+			}
+			continue
+		}
+
+		for _, other := range claimed {
+			if other == sequence {
+				continue
+			}
+			err = co.fs().Remove(co.sequenceFilePath(other))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return 0, fmt.Errorf("can't remove sequence number file: %w", err)
+			}
+		}
+
+		return sequence, nil
+	}
+}
+
+// sequences lists Dir and returns the sequence numbers that are claimed for the lock by files,
+// and the highest sequence number of the wait files in line.
+// The latter keeps the numbers increasing when there are wait files with higher numbers than the claimed ones,
+// e.g. ones that were migrated from another directory.
+func (co *Derailleur) sequences() ([]uint64, uint64, error) {
+	var files []fs.DirEntry
+	err := co.retry(func() error {
+		var err error
+		files, err = co.fs().ReadDir(co.Dir)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var claimed []uint64
+	var highest uint64
+	prefix := co.sequenceFileNamePrefix()
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		if number := strings.TrimPrefix(f.Name(), prefix); number != f.Name() && isNumber(number) {
+			sequence, err := strconv.ParseUint(number, 10, 64)
+			if err == nil {
+				claimed = append(claimed, sequence)
+			}
+			continue
+		}
+
+		name, ok := parseWaitFileName(co.prefix(), f.Name())
+		if !ok || name.lock != co.Name {
+			continue
+		}
+		sequence, err := strconv.ParseUint(name.sequence, 10, 64)
+		if err == nil && sequence > highest {
+			highest = sequence
+		}
+	}
+
+	return claimed, highest, nil
+}
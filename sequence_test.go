@@ -0,0 +1,138 @@
+package derailleur
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNextSequence(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The clocks of the two contenders are an hour apart, as if they ran on different hosts.
+	behind := newFakeClock()
+	behind.Advance(-time.Hour)
+	contenders := []*Derailleur{
+		{Dir: dir, Sequenced: true, Clock: behind},
+		{Dir: dir, Sequenced: true, Clock: newFakeClock()},
+	}
+
+	const joins = 50
+
+	// Name and create the wait files without going through createMu, like separate processes would.
+	joined := make([][]string, len(contenders))
+	errs := make(chan error, len(contenders))
+	var wg sync.WaitGroup
+	for i, co := range contenders {
+		wg.Add(1)
+		go func(i int, co *Derailleur) {
+			defer wg.Done()
+			for j := 0; j < joins; j++ {
+				name, err := co.newWaitFileName()
+				if err != nil {
+					errs <- err
+					return
+				}
+				filePath := path.Join(dir, name)
+				err = os.WriteFile(filePath, nil, defaultFilePerm)
+				if err != nil {
+					errs <- err
+					return
+				}
+				joined[i] = append(joined[i], filePath)
+			}
+		}(i, co)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	line, err := contenders[0].waitFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(line) != len(contenders)*joins {
+		t.Fatalf("expected %d wait files, got %d", len(contenders)*joins, len(line))
+	}
+
+	position := make(map[string]int, len(line))
+	var last uint64
+	for i, f := range line {
+		sequence, err := strconv.ParseUint(f.name.sequence, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sequence <= last {
+			t.Fatalf("expected unique increasing sequence numbers, got %d after %d", sequence, last)
+		}
+		last = sequence
+		position[f.path] = i
+	}
+
+	// Each contender stays behind the wait files that it created before, whatever the clock of the other one says.
+	for _, files := range joined {
+		for j := 1; j < len(files); j++ {
+			if position[files[j]] < position[files[j-1]] {
+				t.Fatalf("expected %s to be behind %s", files[j], files[j-1])
+			}
+		}
+	}
+
+	// Only the claim of the highest number is kept.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), sequenceFilePrefix) {
+			claims = append(claims, entry.Name())
+		}
+	}
+	if len(claims) != 1 || claims[0] != "sequence-"+strconv.FormatUint(last, 10) {
+		t.Fatalf("expected only the claim of %d to be kept, got %v", last, claims)
+	}
+}
+
+func TestNextSequenceNamed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The claims of different locks don't interfere, even if a lock name ends with a number.
+	locks := []*Derailleur{
+		{Dir: dir, Sequenced: true},
+		{Dir: dir, Name: "a", Sequenced: true},
+		{Dir: dir, Name: "a-1", Sequenced: true},
+	}
+	for _, co := range locks {
+		for want := uint64(1); want <= 3; want++ {
+			sequence, err := co.nextSequence()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sequence != want {
+				t.Fatalf("expected sequence number %d of lock %q, got %d", want, co.Name, sequence)
+			}
+		}
+	}
+
+	for _, name := range []string{"sequence-3", "sequence-a-3", "sequence-a-1-3"} {
+		_, err := os.Stat(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package derailleur
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// InstallSignalCleanup removes the wait file of the lock contender when the process receives one of the signals,
+// SIGINT and SIGTERM by default, so that an interrupted process doesn't leave it behind to block the line.
+// After the wait file is removed, the signal is delivered again without the handler, so the process
+// terminates as it would have otherwise, unless the signal is also handled elsewhere.
+// The returned function removes the handler again. The cleanup is best-effort:
+// it can't run when the process is killed with SIGKILL or crashes.
+func (co *Derailleur) InstallSignalCleanup(signals ...os.Signal) func() {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+
+	done := make(chan struct{})
+	var once sync.Once
+	deregister := func() {
+		once.Do(func() {
+			signal.Stop(received)
+			close(done)
+		})
+	}
+
+	go func() {
+		select {
+		case sig := <-received:
+			filePath := co.filePath()
+			if filePath != "" {
+				err := co.removeWaitFile(filePath)
+				if err != nil {
+					co.logger().Errorf("Failed to remove wait file %s on %s: %v", filePath, sig, err)
+				}
+			}
+			deregister()
+			raise(sig)
+		case <-done:
+		}
+	}()
+
+	return deregister
+}
+
+// raise delivers the signal to the own process. If that isn't supported, e.g. for an interrupt on Windows,
+// the process exits right away instead.
+func raise(sig os.Signal) {
+	process, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = process.Signal(sig)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,79 @@
+//go:build !windows
+
+package derailleur
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInstallSignalCleanup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// SIGWINCH is ignored by default, so delivering it again after the cleanup doesn't end the test.
+	deregister := derailleur.InstallSignalCleanup(syscall.SIGWINCH)
+	defer deregister()
+
+	err = syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(file.Name()); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("wait file not removed on signal")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInstallSignalCleanupDeregister(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	deregister := derailleur.InstallSignalCleanup(syscall.SIGWINCH)
+	deregister()
+
+	err = syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(file.Name()); err != nil {
+		t.Fatal("wait file removed after deregistering")
+	}
+}
@@ -0,0 +1,59 @@
+package derailleur
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// status is the JSON document that is served by StatusHandler.
+type status struct {
+	Depth   int           `json:"depth"`
+	Entries []statusEntry `json:"entries"`
+}
+
+// statusEntry describes a lock contender in the document that is served by StatusHandler.
+type statusEntry struct {
+	Path       string  `json:"path"`
+	AgeSeconds float64 `json:"age_seconds"`
+	PID        int     `json:"pid,omitempty"`
+	Hostname   string  `json:"hostname,omitempty"`
+}
+
+// StatusHandler returns an http.Handler that serves the line as JSON, with the number of contenders
+// and the contenders in the order in which they are queued. It only reads Dir,
+// so it can serve requests while contenders are waiting in line.
+func (co *Derailleur) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		entries, err := co.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		doc := status{
+			Depth:   len(entries),
+			Entries: make([]statusEntry, 0, len(entries)),
+		}
+		now := co.clock().Now()
+		for _, entry := range entries {
+			e := statusEntry{
+				Path:     entry.FilePath,
+				PID:      entry.PID,
+				Hostname: entry.Hostname,
+			}
+			if !entry.CreatedAt.IsZero() {
+				e.AgeSeconds = now.Sub(entry.CreatedAt).Seconds()
+			}
+			doc.Entries = append(doc.Entries, e)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(doc)
+	})
+}
@@ -0,0 +1,63 @@
+package derailleur
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestStatusHandler(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+
+	var filePaths []string
+	for i := 0; i < 2; i++ {
+		file, err := derailleur.createWaitFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		filePaths = append(filePaths, file.Name())
+	}
+
+	handler := derailleur.StatusHandler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+
+	var doc status
+	err = json.NewDecoder(recorder.Body).Decode(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Depth != 2 || len(doc.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", doc)
+	}
+	for i, entry := range doc.Entries {
+		if entry.Path != filePaths[i] || entry.PID != os.Getpid() || entry.AgeSeconds < 0 {
+			t.Fatalf("unexpected entry %+v at position %d", entry, i)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,170 @@
+package derailleur
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// QueueEventKind is the kind of change to the line that a QueueEvent describes.
+type QueueEventKind int
+
+const (
+	// Enqueued is the kind of QueueEvent of a wait file that joins the line.
+	Enqueued QueueEventKind = iota
+	// Dequeued is the kind of QueueEvent of a wait file that leaves the line,
+	// whether it is released, removed by someone else or renamed.
+	Dequeued
+)
+
+// String returns the name of the kind of event.
+func (k QueueEventKind) String() string {
+	if k == Dequeued {
+		return "dequeued"
+	}
+	return "enqueued"
+}
+
+// QueueEvent is a change to the line of a lock that is sent by Subscribe.
+type QueueEvent struct {
+	Kind     QueueEventKind
+	FilePath string
+}
+
+// Subscribe returns a channel on which every change to the line of the lock is sent, e.g. for a control plane
+// that keeps track of all lock contenders rather than waiting for a single one like WaitForFile.
+// The wait files that are already in line are sent first as Enqueued, in the order in which they are queued,
+// so that the events describe the whole line. Dir is watched before it is listed, so no change is missed in between.
+// A wait file that is renamed, e.g. by Downgrade or ForceAcquire, or when it is marked as held, is dequeued
+// under its old path and enqueued under its new one. Files in Dir that aren't wait files of the lock are ignored.
+//
+// The channel is closed once the context is cancelled, Dir is removed, or watching fails. If WatcherErrors is set,
+// errors of the watcher are forwarded to it instead, and the changes that may have been missed are sent
+// after listing Dir again. It returns an error if the watcher can't be set up or Dir can't be listed.
+func (co *Derailleur) Subscribe(ctx context.Context) (<-chan QueueEvent, error) {
+	watcher, err := newWatcher([]string{co.Dir}, co.watcherSetupTimeout())
+	if err != nil {
+		return nil, err
+	}
+
+	line, err := co.line()
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	events := make(chan QueueEvent)
+
+	go func() {
+		defer close(events)
+		defer watcher.Close()
+
+		queued := make(map[string]bool)
+		send := func(kind QueueEventKind, filePath string) bool {
+			if kind == Enqueued {
+				queued[filePath] = true
+			} else {
+				delete(queued, filePath)
+			}
+
+			select {
+			case events <- QueueEvent{Kind: kind, FilePath: filePath}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// resync sends the changes between the wait files that were sent as queued so far and the line.
+		resync := func(line []string) bool {
+			inLine := make(map[string]bool, len(line))
+			for _, filePath := range line {
+				inLine[filePath] = true
+			}
+
+			var gone []string
+			for filePath := range queued {
+				if !inLine[filePath] {
+					gone = append(gone, filePath)
+				}
+			}
+			sort.Strings(gone)
+
+			for _, filePath := range gone {
+				if !send(Dequeued, filePath) {
+					return false
+				}
+			}
+			for _, filePath := range line {
+				if !queued[filePath] && !send(Enqueued, filePath) {
+					return false
+				}
+			}
+			return true
+		}
+
+		if !resync(line) {
+			return
+		}
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == filepath.Clean(co.Dir) {
+					if isRemoval(event) {
+						return
+					}
+					continue
+				}
+
+				name := filepath.Base(event.Name)
+				if !co.isWaitFileName(name) {
+					continue
+				}
+				filePath := path.Join(co.Dir, name)
+
+				switch {
+				case event.Op&fsnotify.Create != 0 && !queued[filePath]:
+					if !send(Enqueued, filePath) {
+						return
+					}
+				case isRemoval(event) && queued[filePath]:
+					if !send(Dequeued, filePath) {
+						return
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				if co.WatcherErrors == nil {
+					co.logger().Errorf("watcher error: %v", err)
+					return
+				}
+				co.forwardWatcherError(err)
+
+				// The error may have cost events, e.g. on an overflow, so list the line again.
+				line, err := co.line()
+				if err != nil || !resync(line) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// isWaitFileName reports whether name is the name of a wait file of the lock.
+func (co *Derailleur) isWaitFileName(name string) bool {
+	parsed, ok := parseWaitFileName(co.prefix(), name)
+	return ok && parsed.lock == co.Name
+}
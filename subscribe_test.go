@@ -0,0 +1,139 @@
+package derailleur
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	observer := Derailleur{
+		Dir: dir,
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+
+	events, err := observer.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(kind QueueEventKind, filePath string) {
+		t.Helper()
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s event for %s", kind, filePath)
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("events closed early")
+			}
+			if event.Kind != kind || event.FilePath != filePath {
+				t.Fatalf("expected %s %s, got %s %s", kind, filePath, event.Kind, event.FilePath)
+			}
+		}
+	}
+
+	expect(Enqueued, holder.filePath())
+
+	for _, name := range []string{"unrelated", "queuer-lockA-W-0-0-0-0"} {
+		f, _ := os.Create(path.Join(dir, name))
+		f.Close()
+	}
+
+	waiter := Derailleur{
+		Dir: dir,
+	}
+	file, err := waiter.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	expect(Enqueued, waiter.filePath())
+
+	holderPath := holder.filePath()
+	err = holder.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(Dequeued, holderPath)
+
+	cancelFn()
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("events not closed after cancellation")
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("unexpected event after cancellation")
+		}
+	}
+}
+
+func TestSubscribeDirRemoved(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	derailleur := Derailleur{
+		Dir: dir,
+	}
+	file, err := derailleur.CreateWaitFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	events, err := derailleur.Subscribe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received []QueueEvent
+	timeout := time.After(2 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case <-timeout:
+			t.Fatal("events not closed after removing the directory")
+		case event, ok := <-events:
+			if !ok {
+				closed = true
+				break
+			}
+			received = append(received, event)
+		}
+	}
+
+	if len(received) != 2 || received[0] != (QueueEvent{Enqueued, file.Name()}) || received[1] != (QueueEvent{Dequeued, file.Name()}) {
+		t.Fatalf("unexpected events %v", received)
+	}
+
+	_, err = derailleur.Subscribe(context.Background())
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected an error for a missing directory, got %v", err)
+	}
+}
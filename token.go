@@ -0,0 +1,93 @@
+package derailleur
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// tokenFilePrefix is the prefix of the name of the file that keeps the last fencing token of a lock.
+const tokenFilePrefix = "fencing-token"
+
+// tokenFilePath returns the path of the file that keeps the last fencing token of the lock.
+func (co *Derailleur) tokenFilePath() string {
+	name := tokenFilePrefix
+	if co.Name != "" {
+		name += "-" + co.Name
+	}
+	return path.Join(co.Dir, name)
+}
+
+// tokenWrites counts the writes of fencing tokens in the process to name their temporary files.
+var tokenWrites uint64
+
+// nextToken increments the fencing token of the lock that is persisted in Dir and returns it.
+// It must only be called while holding the lock, which is what keeps the increments from racing
+// with each other. With Shared holders or a Limit greater than 1 the tokens are therefore not guaranteed to be unique.
+func (co *Derailleur) nextToken() (uint64, error) {
+	filePath := co.tokenFilePath()
+
+	var token uint64
+	data, err := co.fs().ReadFile(filePath)
+	if err == nil {
+		token, err = parseToken(data)
+		if err != nil {
+			return 0, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	token++
+
+	// Replace the file atomically, so that a crash can't leave a corrupted token behind.
+	// Holders that increment the token at the same time each write their own temporary file.
+	tempPath := tokenTempPath(filePath)
+	err = co.fs().WriteFile(tempPath, []byte(strconv.FormatUint(token, 10)), co.filePerm())
+	if err != nil {
+		return 0, err
+	}
+	err = co.fs().Rename(tempPath, filePath)
+	if err != nil {
+		return 0, err
+	}
+
+	return token, nil
+}
+
+// parseToken parses the contents of the file that keeps the last fencing token of a lock.
+func parseToken(data []byte) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// tokenTempPath returns a unique path for a temporary file that replaces the fencing token file at filePath.
+func tokenTempPath(filePath string) string {
+	return fmt.Sprintf("%s.tmp-%d-%d", filePath, os.Getpid(), atomic.AddUint64(&tokenWrites, 1))
+}
+
+// isTokenFileName reports whether name is the name of the file that keeps the last fencing token of some lock.
+func isTokenFileName(name string) bool {
+	if name == tokenFilePrefix {
+		return true
+	}
+	lock := strings.TrimPrefix(name, tokenFilePrefix+"-")
+	return lock != name && lock != "" && validateName(lock) == nil
+}
+
+// Token returns the fencing token that was issued when the lock contender acquired the lock with Lock.
+// Fencing tokens of a lock strictly increase with every acquisition, even across process restarts,
+// so that storage guarded by the lock can reject operations that carry an older token than it has already seen
+// from a holder that lost the lock in the meantime.
+func (co *Derailleur) Token() uint64 {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.token
+}
+
+// Token returns the fencing token that was issued when the lock was acquired. See Derailleur.Token.
+func (l *Lock) Token() uint64 {
+	return l.token
+}
@@ -0,0 +1,113 @@
+package derailleur
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var last uint64
+	for i := 0; i < 3; i++ {
+		// A new Derailleur every time simulates a restarted process.
+		derailleur := Derailleur{
+			Dir: dir,
+		}
+
+		err := derailleur.Lock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if derailleur.Token() <= last {
+			t.Fatalf("token %d doesn't increase on %d", derailleur.Token(), last)
+		}
+		last = derailleur.Token()
+
+		err = derailleur.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lock, err := derailleur.Acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lock.Token() <= last {
+			t.Fatalf("token %d doesn't increase on %d", lock.Token(), last)
+		}
+		last = lock.Token()
+
+		err = lock.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Other locks in the same directory have their own tokens.
+	other := Derailleur{
+		Dir:  dir,
+		Name: "other",
+	}
+	err = other.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Release()
+
+	if other.Token() != 1 {
+		t.Fatalf("expected token 1 for a new lock, got %d", other.Token())
+	}
+}
+
+func TestTokenShared(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Hold the lock, so that the Shared contenders acquire it all at once.
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			derailleur := Derailleur{
+				Dir:  dir,
+				Mode: Shared,
+			}
+			err := derailleur.Lock(context.Background())
+			if err == nil {
+				err = derailleur.Release()
+			}
+			errs <- err
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	err = holder.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		err := <-errs
+		if err != nil {
+			t.Fatalf("Shared holders failed to get tokens at the same time: %v", err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+// ErrUpgradeDeadlock is returned by Upgrade when another Shared holder ahead in line is upgrading as well.
+// Neither upgrade could complete while the other contender keeps its shared lock, so the one further
+// back in line gives up. It still holds its shared lock, which it should release to let the other upgrade proceed.
+var ErrUpgradeDeadlock = errors.New("another holder ahead in line is upgrading")
+
+// errNotHeld is returned by Upgrade when the contender doesn't hold the lock yet.
+var errNotHeld = errors.New("lock must be held to be upgraded")
+
+// Downgrade converts the exclusive lock of the contender into a shared one without giving up its place in line,
+// so that Shared contenders waiting behind it can acquire the lock alongside it. The wait file is renamed,
+// and FilePath is updated to the new path. It does nothing if the wait file is already Shared.
+func (co *Derailleur) Downgrade() error {
+	filePath := co.filePath()
+	if filePath == "" {
+		return ErrNotInQueue
+	}
+
+	line, i, err := co.find(filePath)
+	if err != nil {
+		return err
+	}
+
+	name := line[i].name
+	if name.mode == Shared && !name.upgrading {
+		return nil
+	}
+	name.mode = Shared
+	name.upgrading = false
+
+	_, err = co.renameWaitFile(filePath, name)
+	return err
+}
+
+// Upgrade converts the shared lock held by the contender into an exclusive one without giving up its place in line.
+// It blocks until the other Shared holders have released the lock, which may take indefinitely if new Shared
+// contenders keep joining the line, as they may still acquire the lock in the meantime.
+// The wait file is renamed, and FilePath is updated to the new path. It does nothing if the wait file is already Exclusive.
+//
+// If another holder ahead in line is upgrading as well, Upgrade returns ErrUpgradeDeadlock instead of waiting for it.
+// If the context is cancelled, the context's error is returned. In both cases the contender keeps its shared lock.
+func (co *Derailleur) Upgrade(ctx context.Context) error {
+	filePath := co.filePath()
+	if filePath == "" {
+		return ErrNotInQueue
+	}
+
+	line, i, err := co.find(filePath)
+	if err != nil {
+		return err
+	}
+	if line[i].name.mode == Exclusive {
+		return nil
+	}
+	if len(co.blockers(line, i)) != 0 {
+		return errNotHeld
+	}
+
+	// Mark the wait file, so that other holders that try to upgrade can tell that this one does too.
+	name := line[i].name
+	name.upgrading = true
+	filePath, err = co.renameWaitFile(filePath, name)
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, i, err = co.find(filePath)
+		if errors.Is(err, ErrNotInQueue) {
+			return ErrLockLost
+		}
+		if err != nil {
+			return co.abortUpgrade(filePath, name, err)
+		}
+
+		for _, f := range line[:i] {
+			if f.name.upgrading {
+				return co.abortUpgrade(filePath, name, ErrUpgradeDeadlock)
+			}
+		}
+
+		waitFor := co.upgradeBlockers(line, i)
+		if len(waitFor) > 0 {
+			_, err = co.WaitForAny(ctx, waitFor)
+			if err != nil {
+				return co.abortUpgrade(filePath, name, err)
+			}
+			continue
+		}
+
+		name.mode = Exclusive
+		name.upgrading = false
+		filePath, err = co.renameWaitFile(filePath, name)
+		if err != nil {
+			return err
+		}
+
+		// Shared contenders that checked the line before the rename may have acquired the lock,
+		// and they are all in line by now. Any other contender sees the Exclusive wait file.
+		line, i, err = co.find(filePath)
+		if errors.Is(err, ErrNotInQueue) {
+			return ErrLockLost
+		}
+		if err == nil && len(co.upgradeBlockers(line, i)) == 0 {
+			return nil
+		}
+
+		// Let Shared contenders that are waiting for the Exclusive wait file acquire the lock, and wait for them.
+		name.mode = Shared
+		name.upgrading = true
+		filePath, err = co.renameWaitFile(filePath, name)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// upgradeBlockers returns the paths of the wait files that the upgrading contender at index i of the line
+// is waiting for: the ones it would wait for if it were Exclusive, and the Shared holders behind it.
+func (co *Derailleur) upgradeBlockers(line []waitFile, i int) []string {
+	own := line[i].name
+	line[i].name.mode = Exclusive
+	blockers := co.blockers(line, i)
+	line[i].name = own
+
+	// Shared contenders behind are holders as well, unless an Exclusive contender ahead of them is waiting.
+	for _, f := range line[i+1:] {
+		if f.name.mode == Exclusive {
+			break
+		}
+		blockers = append(blockers, f.path)
+	}
+
+	return blockers
+}
+
+// abortUpgrade reverts the wait file at filePath with the given name to a plain Shared one and returns err.
+func (co *Derailleur) abortUpgrade(filePath string, name waitFileName, err error) error {
+	name.mode = Shared
+	name.upgrading = false
+
+	_, renameErr := co.renameWaitFile(filePath, name)
+	if renameErr != nil {
+		return renameErr
+	}
+	return err
+}
+
+// renameWaitFile renames the wait file at filePath to the given name in the same directory,
+// which keeps its place in line as long as only the mode changes, and updates FilePath.
+// It returns ErrLockLost if the wait file was removed.
+func (co *Derailleur) renameWaitFile(filePath string, name waitFileName) (string, error) {
+	newPath, err := co.moveWaitFile(filePath, name)
+	if err != nil {
+		return "", err
+	}
+
+	co.setFilePath(newPath)
+	return newPath, nil
+}
+
+// moveWaitFile is like renameWaitFile, but leaves FilePath alone.
+func (co *Derailleur) moveWaitFile(filePath string, name waitFileName) (string, error) {
+	newPath := path.Join(path.Dir(filePath), name.format(co.prefix()))
+
+	err := co.retry(func() error {
+		return co.fs().Rename(filePath, newPath)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrLockLost
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return newPath, nil
+}
+
+// find returns the line and the index of the wait file at filePath in it.
+func (co *Derailleur) find(filePath string) ([]waitFile, int, error) {
+	line, err := co.waitFiles()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i, f := range line {
+		if f.path == filePath {
+			return line, i, nil
+		}
+	}
+
+	return nil, 0, fmt.Errorf("%w: %s not found in %s", ErrNotInQueue, filePath, co.Dir)
+}
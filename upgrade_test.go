@@ -0,0 +1,204 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDowngrade(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer := Derailleur{
+		Dir: dir,
+	}
+	err = writer.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := Derailleur{
+		Dir:  dir,
+		Mode: Shared,
+	}
+	done := make(chan error)
+
+	go func() {
+		done <- reader.Lock(context.Background())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Shared lock acquired while the exclusive lock is held.")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = writer.Downgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shared lock not acquired after downgrade.")
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	position, err := writer.Position()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 0 {
+		t.Fatalf("expected the downgraded contender to keep position 0, got %d", position)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upgrader := Derailleur{
+		Dir:  dir,
+		Mode: Shared,
+	}
+	err = upgrader.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := Derailleur{
+		Dir:  dir,
+		Mode: Shared,
+	}
+	err = other.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgraded := make(chan error)
+
+	go func() {
+		upgraded <- upgrader.Upgrade(context.Background())
+	}()
+
+	select {
+	case <-upgraded:
+		t.Fatal("Upgraded while another shared lock is held.")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = other.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Not upgraded after the other shared lock was released.")
+	case err := <-upgraded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := Derailleur{
+		Dir:  dir,
+		Mode: Shared,
+	}
+	acquired := make(chan error)
+
+	go func() {
+		acquired <- reader.Lock(context.Background())
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Shared lock acquired while the upgraded lock is held.")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = upgrader.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shared lock not acquired after the upgraded lock was released.")
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUpgradeDeadlock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := Derailleur{
+		Dir:  dir,
+		Mode: Shared,
+	}
+	err = first.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := Derailleur{
+		Dir:  dir,
+		Mode: Shared,
+	}
+	err = second.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstDone := make(chan error, 1)
+	secondDone := make(chan error, 1)
+
+	go func() {
+		firstDone <- first.Upgrade(context.Background())
+	}()
+	go func() {
+		secondDone <- second.Upgrade(context.Background())
+	}()
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Deadlocked upgrades not detected.")
+	case err := <-secondDone:
+		if !errors.Is(err, ErrUpgradeDeadlock) {
+			t.Fatalf("expected ErrUpgradeDeadlock, got %v", err)
+		}
+	}
+
+	err = second.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Not upgraded after the other holder released its lock.")
+	case err := <-firstDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package derailleur
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Validate checks that dir can be used as the Dir of lock contenders, so that setup scripts can fail fast
+// on a misconfigured shared volume instead of at the first acquisition. The directory must either exist
+// and be writable, or be creatable in a writable parent directory, and the files in it whose names start
+// with the default Prefix must be valid wait files, apart from wait files that were left behind while being released.
+// It doesn't create dir, and leaves no files behind.
+func Validate(dir string) error {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return validateCreatable(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("can't access %s: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	err = validateWritable(dir)
+	if err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("can't list %s: %w", dir, err)
+	}
+
+	for _, f := range files {
+		// Wait files that were left behind while being released with RenameOnRelease are out of line already.
+		if !strings.HasPrefix(f.Name(), defaultPrefix+"-") || strings.HasSuffix(f.Name(), releasingSuffix) {
+			continue
+		}
+		if f.IsDir() {
+			return fmt.Errorf("%s in %s is a directory, not a wait file", f.Name(), dir)
+		}
+		if _, ok := parseWaitFileName(defaultPrefix, f.Name()); !ok {
+			return fmt.Errorf("%s in %s is not a valid wait file name", f.Name(), dir)
+		}
+	}
+
+	return nil
+}
+
+// validateCreatable checks that the missing directory dir can be created,
+// i.e. that its closest existing ancestor is a writable directory.
+func validateCreatable(dir string) error {
+	parent := filepath.Dir(filepath.Clean(dir))
+	for {
+		info, err := os.Stat(parent)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("can't create %s: %s is not a directory", dir, parent)
+			}
+			return validateWritable(parent)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("can't create %s: %w", dir, err)
+		}
+
+		next := filepath.Dir(parent)
+		if next == parent {
+			return fmt.Errorf("can't create %s: %w", dir, err)
+		}
+		parent = next
+	}
+}
+
+// validateWritable checks that files can be created in dir by creating and removing one.
+func validateWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".validate-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+
+	err = os.Remove(f.Name())
+	if err != nil {
+		return fmt.Errorf("can't remove files from %s: %w", dir, err)
+	}
+
+	return nil
+}
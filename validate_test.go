@@ -0,0 +1,62 @@
+package derailleur
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = Validate(dir)
+	if err != nil {
+		t.Fatalf("empty directory: %v", err)
+	}
+
+	missing := path.Join(dir, "a", "b")
+	err = Validate(missing)
+	if err != nil {
+		t.Fatalf("creatable directory: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Fatal("Validate created a directory")
+	}
+
+	for _, name := range []string{"queuer-W-0-0-0-0", "queuer-lockA-R-0-0-0-0", "queuer-W-0-1-0-0" + releasingSuffix, "unrelated"} {
+		f, _ := os.Create(path.Join(dir, name))
+		f.Close()
+	}
+
+	err = Validate(dir)
+	if err != nil {
+		t.Fatalf("directory with valid files: %v", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 4 {
+		t.Fatalf("expected Validate to leave no files behind, got %d files", len(files))
+	}
+
+	err = Validate(path.Join(dir, "unrelated"))
+	if err == nil {
+		t.Fatal("expected an error for a file")
+	}
+
+	err = Validate(path.Join(dir, "unrelated", "sub"))
+	if err == nil {
+		t.Fatal("expected an error for a directory under a file")
+	}
+
+	f, _ := os.Create(path.Join(dir, "queuer-W-x"))
+	f.Close()
+
+	err = Validate(dir)
+	if err == nil {
+		t.Fatal("expected an error for an invalid wait file")
+	}
+}
@@ -0,0 +1,281 @@
+package derailleur
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// errEventsDropped is sent to a subscription of shared watchers when it falls behind and misses events,
+// after which the watched files have to be checked again.
+var errEventsDropped = errors.New("events of a shared watcher were dropped")
+
+// subscriptionBuffer is how many events a subscription of shared watchers buffers before it misses events.
+const subscriptionBuffer = 64
+
+// sharedWatches holds the watches of the process that are shared by waiters in line, by the path they watch,
+// so that thousands of contenders in the same Dir use a single inotify watch instead of one each.
+// All of them are added to a single watcher, so that contenders that watch many different files with WatchFiles
+// don't use up the inotify instances of the user, of which there are far fewer than watches.
+var sharedWatches = struct {
+	mu sync.Mutex
+	// watcher is the watcher that the watches are added to. It is created along with the first watch
+	// and closed once the last one is removed, and users counts the watches that use it until then.
+	watcher *fsnotify.Watcher
+	users   int
+	watches map[string]*sharedWatch
+	// removing holds the channels that are closed once watches that are no longer shared are removed from the watcher,
+	// by their targets, so that a new watch of the same target isn't added before that, which would remove it as well.
+	removing map[string]chan struct{}
+}{watches: make(map[string]*sharedWatch), removing: make(map[string]chan struct{})}
+
+// sharedWatch is a watch of a single path that dispatches its events to all of its subscriptions.
+type sharedWatch struct {
+	target  string
+	watcher *fsnotify.Watcher
+	// ready is closed once target is added to the watcher, or adding it failed with err.
+	ready chan struct{}
+	err   error
+	// settled is set once adding the target is done, added if it was added, and retired once the watch is removed.
+	settled       bool
+	added         bool
+	retired       bool
+	subscriptions map[*watchSubscription]bool
+}
+
+// watchSubscription receives the events and errors of the shared watches of a set of paths.
+type watchSubscription struct {
+	events  chan fsnotify.Event
+	errors  chan error
+	watches []*sharedWatch
+}
+
+// subscribeWatches subscribes to the events of shared watches of the targets, adding the ones that don't exist yet
+// within the timeout. The subscription has to be cancelled with unsubscribe once it is no longer needed.
+// Watches are added without holding up the other waiters of the process: waiters that need a watch
+// that is still being added wait for it, while all others subscribe right away.
+func subscribeWatches(targets []string, timeout time.Duration) (*watchSubscription, error) {
+	sub := &watchSubscription{
+		events: make(chan fsnotify.Event, subscriptionBuffer),
+		errors: make(chan error, 1),
+	}
+
+	sharedWatches.mu.Lock()
+	for _, target := range targets {
+		w, ok := sharedWatches.watches[target]
+		if !ok {
+			watcher, err := useSharedWatcherLocked()
+			if err != nil {
+				sub.unsubscribeLocked()
+				sharedWatches.mu.Unlock()
+				return nil, err
+			}
+
+			w = &sharedWatch{
+				target:        target,
+				watcher:       watcher,
+				ready:         make(chan struct{}),
+				subscriptions: make(map[*watchSubscription]bool),
+			}
+			sharedWatches.watches[target] = w
+			go w.add(sharedWatches.removing[target])
+		}
+
+		w.subscriptions[sub] = true
+		sub.watches = append(sub.watches, w)
+	}
+	sharedWatches.mu.Unlock()
+
+	// Adding a watch can hang, e.g. on an unresponsive network filesystem, in which case it is left to finish
+	// in the background. The watch is removed again once it is added if no one is subscribed to it anymore.
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for _, w := range sub.watches {
+		select {
+		case <-w.ready:
+			if w.err != nil {
+				sub.unsubscribe()
+				return nil, w.err
+			}
+		case <-timer.C:
+			sub.unsubscribe()
+			return nil, watcherSetupError{fmt.Errorf("timed out after %s", timeout)}
+		}
+	}
+
+	return sub, nil
+}
+
+// useSharedWatcherLocked returns the watcher that shared watches are added to, creating it if needed,
+// and counts the watch that is going to use it.
+func useSharedWatcherLocked() (*fsnotify.Watcher, error) {
+	if sharedWatches.watcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, watcherSetupError{err}
+		}
+		sharedWatches.watcher = watcher
+		go dispatch(watcher)
+	}
+
+	sharedWatches.users++
+	return sharedWatches.watcher, nil
+}
+
+// releaseSharedWatcherLocked stops counting a watch that used the watcher, and closes the watcher if it was the last one.
+func releaseSharedWatcherLocked(watcher *fsnotify.Watcher) {
+	sharedWatches.users--
+	if sharedWatches.users > 0 || sharedWatches.watcher != watcher {
+		return
+	}
+
+	sharedWatches.watcher = nil
+	// Closing an inotify instance can take milliseconds, which would hold up the waiter that just got its turn.
+	// The dispatching goroutine exits once the watcher is closed.
+	go watcher.Close()
+}
+
+// add adds the target to the watcher once the watch of the same target that was removed before, if any, is gone.
+// The watch is only shared if target exists, so that it isn't reused while watching nothing.
+func (w *sharedWatch) add(removed <-chan struct{}) {
+	if removed != nil {
+		<-removed
+	}
+	err := w.watcher.Add(w.target)
+
+	sharedWatches.mu.Lock()
+	defer sharedWatches.mu.Unlock()
+	defer close(w.ready)
+
+	w.settled = true
+	w.added = err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		w.err = watcherSetupError{err}
+	}
+	if !w.added || len(w.subscriptions) == 0 {
+		// Every subscription gave up waiting for the watch, or there is nothing to share.
+		w.retireLocked()
+	}
+}
+
+// retireLocked stops sharing the watch and removes it from the watcher, unless it is still being added.
+func (w *sharedWatch) retireLocked() {
+	if !w.settled || w.retired {
+		return
+	}
+	w.retired = true
+
+	if sharedWatches.watches[w.target] == w {
+		delete(sharedWatches.watches, w.target)
+	}
+	if !w.added {
+		releaseSharedWatcherLocked(w.watcher)
+		return
+	}
+
+	removed := make(chan struct{})
+	sharedWatches.removing[w.target] = removed
+	go func() {
+		// The watch is gone already if its target was removed.
+		_ = w.watcher.Remove(w.target)
+
+		sharedWatches.mu.Lock()
+		defer sharedWatches.mu.Unlock()
+
+		if sharedWatches.removing[w.target] == removed {
+			delete(sharedWatches.removing, w.target)
+		}
+		close(removed)
+		releaseSharedWatcherLocked(w.watcher)
+	}()
+}
+
+// dispatch passes the events and errors of the watcher on to the subscriptions of its watches until it is closed.
+// Events of a directory's entries go to the watches of the directory as well as of the entries themselves.
+// A subscription that can't keep up gets errEventsDropped instead of blocking the others.
+func dispatch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			sharedWatches.mu.Lock()
+			targets := []string{event.Name}
+			if dir := filepath.Dir(event.Name); dir != event.Name {
+				targets = append(targets, dir)
+			}
+			for _, target := range targets {
+				w, ok := sharedWatches.watches[target]
+				if !ok || w.watcher != watcher {
+					continue
+				}
+
+				for sub := range w.subscriptions {
+					select {
+					case sub.events <- event:
+					default:
+						sub.send(errEventsDropped)
+					}
+				}
+				// The watch ends when the watched path is removed, so it can't be shared anymore.
+				if target == event.Name && isRemoval(event) {
+					w.retireLocked()
+				}
+			}
+			sharedWatches.mu.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+
+			sharedWatches.mu.Lock()
+			for _, w := range sharedWatches.watches {
+				if w.watcher != watcher {
+					continue
+				}
+				for sub := range w.subscriptions {
+					sub.send(err)
+				}
+			}
+			sharedWatches.mu.Unlock()
+		}
+	}
+}
+
+// send sends err to the subscription unless an error is already pending.
+func (sub *watchSubscription) send(err error) {
+	select {
+	case sub.errors <- err:
+	default:
+	}
+}
+
+// unsubscribe cancels the subscription and closes its channels.
+// Shared watches without any subscriptions left are removed.
+func (sub *watchSubscription) unsubscribe() {
+	sharedWatches.mu.Lock()
+	defer sharedWatches.mu.Unlock()
+
+	sub.unsubscribeLocked()
+}
+
+func (sub *watchSubscription) unsubscribeLocked() {
+	for _, w := range sub.watches {
+		delete(w.subscriptions, sub)
+		if len(w.subscriptions) == 0 {
+			w.retireLocked()
+		}
+	}
+	sub.watches = nil
+
+	close(sub.events)
+	close(sub.errors)
+}
@@ -0,0 +1,222 @@
+package derailleur
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// sharedWatchState returns the number of shared watches and the number of their subscriptions.
+func sharedWatchState() (int, int) {
+	sharedWatches.mu.Lock()
+	defer sharedWatches.mu.Unlock()
+
+	subscriptions := 0
+	for _, w := range sharedWatches.watches {
+		subscriptions += len(w.subscriptions)
+	}
+	return len(sharedWatches.watches), subscriptions
+}
+
+func TestSharedWatches(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			derailleur := Derailleur{
+				Dir: dir,
+			}
+			err := derailleur.Lock(context.Background())
+			if err == nil {
+				err = derailleur.Release()
+			}
+			errs <- err
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		watches, subscriptions := sharedWatchState()
+		if subscriptions == n {
+			if watches != 1 {
+				t.Fatalf("expected the waiters to share 1 watch, got %d", watches)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d subscriptions, got %d", n, subscriptions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = holder.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-time.After(5 * time.Second):
+			t.Fatal("Waiters not woken up through the shared watcher.")
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if watches, _ := sharedWatchState(); watches != 0 {
+		t.Fatalf("expected the shared watch to be removed once unused, got %d watches", watches)
+	}
+}
+
+func TestSharedWatchSetup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A watcher whose setup hangs, e.g. on an unresponsive network filesystem.
+	hung := &sharedWatch{
+		target:        "/hung",
+		ready:         make(chan struct{}),
+		subscriptions: make(map[*watchSubscription]bool),
+	}
+	sharedWatches.mu.Lock()
+	sharedWatches.watches[hung.target] = hung
+	sharedWatches.mu.Unlock()
+	defer func() {
+		sharedWatches.mu.Lock()
+		delete(sharedWatches.watches, hung.target)
+		sharedWatches.mu.Unlock()
+	}()
+
+	// It doesn't hold up waiters that watch something else.
+	start := time.Now()
+	sub, err := subscribeWatches([]string{dir}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.unsubscribe()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("subscribing took %s while another watcher was being set up", elapsed)
+	}
+
+	// Waiters that need it give up after the setup timeout.
+	_, err = subscribeWatches([]string{hung.target}, 100*time.Millisecond)
+	if !errors.Is(err, ErrWatcherSetup) {
+		t.Fatalf("expected ErrWatcherSetup, got %v", err)
+	}
+	sharedWatches.mu.Lock()
+	subscriptions := len(hung.subscriptions)
+	sharedWatches.mu.Unlock()
+	if subscriptions != 0 {
+		t.Fatalf("expected the subscription that gave up to be cancelled, got %d", subscriptions)
+	}
+}
+
+// inotifyInstances returns the number of inotify instances that the process has open on Linux.
+func inotifyInstances(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances := 0
+	for _, fd := range fds {
+		target, err := os.Readlink(path.Join("/proc/self/fd", fd.Name()))
+		if err == nil && target == "anon_inode:inotify" {
+			instances++
+		}
+	}
+	return instances
+}
+
+func TestSharedWatcherWatchFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("WatchFiles only applies on Linux")
+	}
+
+	dir, err := os.MkdirTemp("", "juju-task-testing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := Derailleur{
+		Dir: dir,
+	}
+	err = holder.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More waiters than there are inotify instances per user by default, each watching a different wait file.
+	n := 200
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			derailleur := Derailleur{
+				Dir:        dir,
+				WatchFiles: true,
+			}
+			err := derailleur.Lock(context.Background())
+			if err == nil {
+				err = derailleur.Release()
+			}
+			errs <- err
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		watches, subscriptions := sharedWatchState()
+		if subscriptions >= n && watches >= n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters to watch at least %d wait files, got %d watching %d", n, n, subscriptions, watches)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The watches share a single inotify instance. Instances of other tests may still be closing.
+	if instances := inotifyInstances(t); instances > 5 {
+		t.Fatalf("expected the wait files to be watched with a single inotify instance, got %d", instances)
+	}
+
+	err = holder.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatal("Waiters not woken up through the shared watcher.")
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}